@@ -0,0 +1,153 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrDenied is passed to a Detector's Reject function, and Limits.OnReject,
+// for connections denied by an ACL.
+var ErrDenied = errors.New("stacked: connection denied")
+
+// ACL decides which clients may connect, by their IP address, as the
+// RemoteAddr that handlers see.  Its rules can be replaced at any time with
+// Set, taking effect for new connections.  See Detector.ACL and
+// Server.SetACL.
+type ACL struct {
+	rules atomic.Pointer[aclRules]
+}
+
+// ACLRules are the rules of an ACL.  Networks are given in CIDR notation, or
+// as single IPs.
+type ACLRules struct {
+	// Allow, if non-empty, lists the only networks allowed.
+	Allow []string
+
+	// Deny lists networks denied, even if they're allowed by Allow.
+	Deny []string
+
+	// Fallthrough makes a Detector pass on denied connections, so that
+	// later Detectors may take them, rather than closing them.
+	Fallthrough bool
+}
+
+type aclRules struct {
+	ACLRules
+	allow, deny []*net.IPNet
+}
+
+// NewACL creates an ACL with the given rules.
+func NewACL(rules ACLRules) (*ACL, error) {
+	acl := &ACL{}
+	if err := acl.Set(rules); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Set replaces the ACL's rules, unless any of them are invalid.
+func (acl *ACL) Set(rules ACLRules) error {
+	allow, err := parseNets(rules.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := parseNets(rules.Deny)
+	if err != nil {
+		return err
+	}
+	acl.rules.Store(&aclRules{rules, allow, deny})
+	return nil
+}
+
+// Rules returns the ACL's current rules.
+func (acl *ACL) Rules() ACLRules {
+	return acl.load().ACLRules
+}
+
+// Allowed returns whether a client address is allowed.  Clients without an
+// IP address, e.g. on Unix sockets, are only allowed if Allow is empty.
+func (acl *ACL) Allowed(addr net.Addr) bool {
+	return acl.load().allowed(addr)
+}
+
+func (acl *ACL) load() *aclRules {
+	if rules := acl.rules.Load(); rules != nil {
+		return rules
+	}
+	return &aclRules{}
+}
+
+func (rules *aclRules) allowed(addr net.Addr) bool {
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return len(rules.allow) == 0
+	}
+	for _, n := range rules.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, n := range rules.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNets(specs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(specs))
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("stacked: invalid ACL address %q", spec)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("stacked: invalid ACL network %q: %w", spec, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// SetACL sets an ACL for all connections to the Server, checked before
+// detection, or removes it if acl is nil.  Denied connections are closed,
+// regardless of Fallthrough.
+func (srv *Server) SetACL(acl *ACL) {
+	srv.acl.Store(acl)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := stacked.NewACL(stacked.ACLRules{
+		Allow:       []string{"10.0.0.0/8"},
+		Fallthrough: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := stacked.PrefixDetector("admin", stacked.HandlerFunc(lineEcho))
+	admin.ACL = acl
+	admin.Reject = func(conn net.Conn, err error) {
+		io.WriteString(conn, err.Error()+"\n")
+	}
+	srv := stacked.NewServer(admin, stacked.FallthroughDetector(stacked.HandlerFunc(
+		func(conn net.Conn, bufr *bufio.Reader) {
+			io.WriteString(conn, "public\n")
+			conn.Close()
+		})))
+	ln := serveTestServer(t, srv)
+
+	if got := dialEcho(t, ln).echo("admin?", time.Second); got != "public\n" {
+		t.Fatalf("expected fall through, got %q", got)
+	}
+
+	if err := acl.Set(stacked.ACLRules{Allow: []string{"10.0.0.0/8", "127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialEcho(t, ln).echo("admin?", time.Second); got != "> admin?\n" {
+		t.Fatalf("expected admin, got %q", got)
+	}
+
+	if err := acl.Set(stacked.ACLRules{Deny: []string{"127.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialEcho(t, ln).echo("admin?", time.Second); got != stacked.ErrDenied.Error()+"\n" {
+		t.Fatalf("expected rejection, got %q", got)
+	}
+
+	if err := acl.Set(stacked.ACLRules{Allow: []string{"bogus"}}); err == nil {
+		t.Fatal("expected invalid rules to fail")
+	}
+	if rules := acl.Rules(); len(rules.Deny) != 1 {
+		t.Fatalf("expected rules to be kept, got %+v", rules)
+	}
+
+	serverACL, err := stacked.NewACL(stacked.ACLRules{Deny: []string{"::/0", "0.0.0.0/0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetACL(serverACL)
+	if got := dialEcho(t, ln).echo("public?", time.Second); got != "" {
+		t.Fatalf("expected to be closed, got %q", got)
+	}
+	srv.SetACL(nil)
+	if got := dialEcho(t, ln).echo("public?", time.Second); got != "public\n" {
+		t.Fatalf("expected public, got %q", got)
+	}
+}
+
+func TestACLRejectHTTP(t *testing.T) {
+	acl, err := stacked.NewACL(stacked.ACLRules{Deny: []string{"127.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	det := stacked.DefaultHTTPHandler(http.NotFoundHandler())
+	det.ACL = acl
+	ln := serveTestServer(t, stacked.NewServer(det))
+
+	req := "GET / HTTP/1.1\r\nHost: test\r\n\r"
+	if got := dialEcho(t, ln).echo(req, time.Second); got != "HTTP/1.1 403 Forbidden\r\n" {
+		t.Fatalf("expected 403, got %q", got)
+	}
+}
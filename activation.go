@@ -0,0 +1,249 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by socket
+	// activation.
+	listenFDsStart = 3
+
+	// restartEnv marks a process started by Restart, whose activated
+	// sockets Listen claims by address.
+	restartEnv = "STACKED_RESTART"
+)
+
+// restarted is whether this process was started by Restart.
+var restarted = os.Getenv(restartEnv) != ""
+
+// activated holds the listeners passed by systemd socket activation, by name,
+// until they're claimed, and remembers the names of all of them, so that
+// Restart can pass them on.
+var activated struct {
+	sync.Mutex
+	once      sync.Once
+	err       error
+	listeners map[string][]net.Listener
+	names     map[net.Listener]string
+}
+
+// ActivatedListeners claims all listening sockets passed by systemd socket
+// activation (see sd_listen_fds(3)) that haven't been claimed yet, keyed by
+// their LISTEN_FDNAMES names; sockets without a name are named "unknown".
+// The LISTEN_* environment variables are unset, so that child processes don't
+// see them.
+func ActivatedListeners() (map[string][]net.Listener, error) {
+	if err := loadActivated(); err != nil {
+		return nil, err
+	}
+	activated.Lock()
+	defer activated.Unlock()
+	named := activated.listeners
+	activated.listeners = nil
+	return named, nil
+}
+
+// activatedListeners claims the activated sockets with the given name, or all
+// of them if name is empty.
+func activatedListeners(name string) ([]net.Listener, error) {
+	lns, err := claimActivated(name)
+	if err == nil && len(lns) == 0 {
+		err = fmt.Errorf("stacked: no activated sockets named %q", name)
+	}
+	return lns, err
+}
+
+// claimRestarted claims the sockets with the given name that were handed
+// over by Restart, if this process was started by it; otherwise, any
+// activated sockets are left alone.
+func claimRestarted(name string) []net.Listener {
+	if !restarted {
+		return nil
+	}
+	lns, err := claimActivated(name)
+	if err != nil {
+		log.Printf("stacked: can't use listeners handed over by restart: %v", err)
+	}
+	return lns
+}
+
+// claimActivated is like activatedListeners, but finding none isn't an error.
+func claimActivated(name string) ([]net.Listener, error) {
+	if err := loadActivated(); err != nil {
+		return nil, err
+	}
+	activated.Lock()
+	defer activated.Unlock()
+	var lns []net.Listener
+	for n, named := range activated.listeners {
+		if name == "" || n == name {
+			lns = append(lns, named...)
+			delete(activated.listeners, n)
+		}
+	}
+	return lns, nil
+}
+
+func loadActivated() error {
+	activated.once.Do(func() {
+		activated.listeners, activated.err = listenFDs()
+		activated.names = make(map[net.Listener]string)
+		for name, lns := range activated.listeners {
+			for _, ln := range lns {
+				activated.names[ln] = name
+			}
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(restartEnv)
+	})
+	return activated.err
+}
+
+// listenFDs turns the sockets described by LISTEN_FDS and LISTEN_FDNAMES into
+// listeners; LISTEN_PID, if set, must be this process.
+func listenFDs() (map[string][]net.Listener, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	nfds := os.Getenv("LISTEN_FDS")
+	if nfds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("stacked: invalid LISTEN_FDS %q", nfds)
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	named := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		ln, err := fdListener(listenFDsStart+i, "LISTEN_FDS:"+name)
+		if err != nil {
+			for _, lns := range named {
+				closeListeners(lns)
+			}
+			return nil, err
+		}
+		named[name] = append(named[name], ln)
+	}
+	return named, nil
+}
+
+// fdListener turns an inherited file descriptor into a listener, closing the
+// original descriptor, since net.FileListener duplicates it.
+func fdListener(fd int, name string) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	if f == nil {
+		return nil, fmt.Errorf("stacked: invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("stacked: file descriptor %d (%s) isn't a listener: %w", fd, name, err)
+	}
+	return ln, nil
+}
+
+// activationName returns the name that ln was passed with by socket
+// activation, if it was.
+func activationName(ln net.Listener) (string, bool) {
+	activated.Lock()
+	defer activated.Unlock()
+	name, ok := activated.names[ln]
+	return name, ok
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// ServeActivated serves the listeners passed by systemd socket activation
+// with the Server for each of their names, e.g. with sockets named "public"
+// and "admin" in the socket unit's FileDescriptorName settings.  Every
+// activated socket needs a Server, and vice versa.  If any Server fails,
+// the others are closed, and ServeActivated returns the failures once all of
+// them are done; once all are shut down, it returns ErrServerClosed.
+func ServeActivated(stacks map[string]*Server) error {
+	named, err := ActivatedListeners()
+	if err != nil {
+		return err
+	}
+	for name := range stacks {
+		if len(named[name]) == 0 {
+			err = errors.Join(err, fmt.Errorf("stacked: no activated sockets named %q", name))
+		}
+	}
+	for name, lns := range named {
+		if stacks[name] == nil {
+			err = errors.Join(err, fmt.Errorf("stacked: no Server for activated sockets named %q", name))
+			closeListeners(lns)
+		}
+	}
+	if err != nil {
+		for name := range stacks {
+			closeListeners(named[name])
+		}
+		return err
+	}
+
+	errs := make(chan error, len(stacks))
+	for name, srv := range stacks {
+		go func() {
+			err := srv.ServeAll(named[name]...)
+			if err != ErrServerClosed {
+				for _, other := range stacks {
+					other.Close()
+				}
+			}
+			errs <- err
+		}()
+	}
+	for range stacks {
+		if serr := <-errs; serr != ErrServerClosed {
+			err = errors.Join(err, serr)
+		}
+	}
+	if err == nil {
+		return ErrServerClosed
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+// TestActivationChild is run in a child process by startChild, serving the
+// sockets passed to it as described by STACKED_TEST_CHILD.
+func TestActivationChild(t *testing.T) {
+	mode := os.Getenv("STACKED_TEST_CHILD")
+	if mode == "" {
+		t.Skip("only run as a child process")
+	}
+	echo := stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho))
+	pid := stacked.FallthroughDetector(stacked.HandlerFunc(
+		func(conn net.Conn, bufr *bufio.Reader) {
+			fmt.Fprintf(conn, "%d %s\n", os.Getpid(), os.Getenv("LISTEN_FDS"))
+			conn.Close()
+		}))
+	var err error
+	switch mode {
+	case "activated":
+		err = stacked.ServeActivated(map[string]*stacked.Server{
+			"echo": stacked.NewServer(echo),
+			"pid":  stacked.NewServer(pid),
+		})
+	case "inherited":
+		err = stacked.NewServer(echo).ListenAndServe("fd:3")
+	case "plain":
+		// not started by Restart, so fd 3 must be left alone
+		var lns []net.Listener
+		if lns, err = stacked.Listen("127.0.0.1:0", stacked.ListenOptions{}); err == nil {
+			lns[0].Close()
+			if _, err = os.NewFile(3, "fd:3").Stat(); err == nil {
+				os.Exit(0)
+			}
+		}
+	case "restart":
+		srv := stacked.NewServer(echo, pid)
+		restarted := make(chan error, 1)
+		srv.RestartOnSignal(stacked.RestartOptions{
+			OnRestart: func(proc *os.Process, err error) { restarted <- err },
+		})
+		// Serve returns as soon as the listeners are handed over, but
+		// connections are still being drained until Restart returns
+		if err = srv.ListenAndServe("fd:3"); err == stacked.ErrServerClosed {
+			err = <-restarted
+		}
+	case "restart-activated":
+		srv := stacked.NewServer(echo, pid)
+		restarted := make(chan error, 1)
+		srv.RestartOnSignal(stacked.RestartOptions{
+			OnRestart: func(proc *os.Process, err error) { restarted <- err },
+		})
+		err = stacked.ServeActivated(map[string]*stacked.Server{"echo": srv})
+		if err == stacked.ErrServerClosed {
+			err = <-restarted
+		}
+	}
+	fmt.Fprintln(os.Stderr, "child exiting:", err)
+	os.Exit(1)
+}
+
+func TestServeActivated(t *testing.T) {
+	echoLn, pidLn := listenLocal(t), listenLocal(t)
+	echoAddr, pidAddr := echoLn.Addr().String(), pidLn.Addr().String()
+	cmd := startChild(t, "activated", []string{
+		"LISTEN_FDS=2",
+		"LISTEN_FDNAMES=echo:pid",
+	}, echoLn, pidLn)
+
+	if got := roundTrip(t, echoAddr, "echo activated"); got != "> echo activated" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	// LISTEN_FDS should be unset once claimed
+	if got, want := roundTrip(t, pidAddr, "pid?"), fmt.Sprintf("%d ", cmd.Process.Pid); got != want {
+		t.Fatalf("expected %q from the pid stack, got %q", want, got)
+	}
+}
+
+func TestListenAndServeInherited(t *testing.T) {
+	ln := listenLocal(t)
+	addr := ln.Addr().String()
+	startChild(t, "inherited", nil, ln)
+
+	if got := roundTrip(t, addr, "echo inherited"); got != "> echo inherited" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}
+
+func TestListenIgnoresActivation(t *testing.T) {
+	for _, nfds := range []string{"x", "1"} {
+		f, err := os.CreateTemp(t.TempDir(), "fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestActivationChild$")
+		cmd.Env = append(os.Environ(), "STACKED_TEST_CHILD=plain", "LISTEN_FDS="+nfds)
+		cmd.ExtraFiles = []*os.File{f}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("LISTEN_FDS=%s: %v\n%s", nfds, err, out)
+		}
+	}
+}
@@ -2,7 +2,11 @@ package stacked
 
 import (
 	"bufio"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"syscall"
 	"time"
 )
 
@@ -10,6 +14,14 @@ import (
 // draining the buffered reader, and then switching over to raw Reads on the
 // connection.  All other net.Conn methods are simply passed through to the
 // connection.
+//
+// Where the connection supports them, bufConn also passes through half-close
+// (CloseWrite and CloseRead), TCP options, SyscallConn and File; otherwise
+// these return an error wrapping errors.ErrUnsupported.
+//
+// bufConn also implements io.WriterTo and io.ReaderFrom, so that once the
+// buffered bytes are drained io.Copy can use the connection's own fast paths
+// (e.g. splice(2) between *net.TCPConns on Linux).
 type bufConn struct {
 	conn net.Conn
 	bufr *bufio.Reader
@@ -44,6 +56,53 @@ func (bufc *bufConn) Write(b []byte) (int, error) {
 	return bufc.conn.Write(b)
 }
 
+// WriteTo writes any buffered data to w, and then copies from the connection
+// using its WriteTo if it has one.
+func (bufc *bufConn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	if bufc.bufr != nil {
+		if m := bufc.bufr.Buffered(); m > 0 {
+			b, _ := bufc.bufr.Peek(m)
+			k, err := w.Write(b)
+			bufc.bufr.Discard(k)
+			n += int64(k)
+			if err != nil {
+				return n, err
+			}
+		}
+		bufc.bufr = nil
+	}
+	if wt, ok := bufc.conn.(io.WriterTo); ok {
+		m, err := wt.WriteTo(w)
+		return n + m, err
+	}
+	m, err := io.Copy(w, bufc.conn)
+	return n + m, err
+}
+
+// ReadFrom copies from r to the connection, using its ReadFrom if it has one.
+func (bufc *bufConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := bufc.conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(bufc.conn, r)
+}
+
+// Unwrap returns the underlying connection.  Reading from it directly skips
+// any bytes still buffered; see Buffered.
+func (bufc *bufConn) Unwrap() net.Conn {
+	return bufc.conn
+}
+
+// Buffered returns how many bytes can be read before reads pass through to
+// the underlying connection.
+func (bufc *bufConn) Buffered() int {
+	if bufc.bufr == nil {
+		return 0
+	}
+	return bufc.bufr.Buffered()
+}
+
 // Close closes the connection.
 func (bufc *bufConn) Close() error {
 	return bufc.conn.Close()
@@ -74,3 +133,84 @@ func (bufc *bufConn) SetReadDeadline(t time.Time) error {
 func (bufc *bufConn) SetWriteDeadline(t time.Time) error {
 	return bufc.conn.SetWriteDeadline(t)
 }
+
+// CloseWrite shuts down the writing side of the connection, if it supports
+// that (e.g. *net.TCPConn).
+func (bufc *bufConn) CloseWrite() error {
+	if cw, ok := bufc.conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return bufc.unsupported("closewrite")
+}
+
+// CloseRead shuts down the reading side of the connection, if it supports
+// that.
+func (bufc *bufConn) CloseRead() error {
+	if cr, ok := bufc.conn.(interface {
+		CloseRead() error
+	}); ok {
+		return cr.CloseRead()
+	}
+	return bufc.unsupported("closeread")
+}
+
+// SetKeepAlive sets whether the connection should send keep-alive messages,
+// if it supports that.
+func (bufc *bufConn) SetKeepAlive(keepalive bool) error {
+	if ka, ok := bufc.conn.(interface {
+		SetKeepAlive(bool) error
+	}); ok {
+		return ka.SetKeepAlive(keepalive)
+	}
+	return bufc.unsupported("set")
+}
+
+// SetKeepAlivePeriod sets the period between keep-alives, if the connection
+// supports that.
+func (bufc *bufConn) SetKeepAlivePeriod(d time.Duration) error {
+	if ka, ok := bufc.conn.(interface {
+		SetKeepAlivePeriod(time.Duration) error
+	}); ok {
+		return ka.SetKeepAlivePeriod(d)
+	}
+	return bufc.unsupported("set")
+}
+
+// SetNoDelay controls Nagle's algorithm, if the connection supports that.
+func (bufc *bufConn) SetNoDelay(noDelay bool) error {
+	if nd, ok := bufc.conn.(interface {
+		SetNoDelay(bool) error
+	}); ok {
+		return nd.SetNoDelay(noDelay)
+	}
+	return bufc.unsupported("set")
+}
+
+// SyscallConn returns a raw network connection, if the connection has one.
+// Reading from it directly skips any bytes still buffered.
+func (bufc *bufConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := bufc.conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, bufc.unsupported("raw-conn")
+}
+
+// File returns a copy of the connection's underlying os.File, if it has
+// one.  Reading from it directly skips any bytes still buffered.
+func (bufc *bufConn) File() (*os.File, error) {
+	if f, ok := bufc.conn.(interface {
+		File() (*os.File, error)
+	}); ok {
+		return f.File()
+	}
+	return nil, bufc.unsupported("file")
+}
+
+func (bufc *bufConn) unsupported(op string) error {
+	return &net.OpError{
+		Op:     op,
+		Source: bufc.conn.LocalAddr(),
+		Addr:   bufc.conn.RemoteAddr(),
+		Err:    errors.ErrUnsupported,
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return client, server
+}
+
+// bufConnPair returns a bufConn whose reader has buffered a detected
+// prefix, along with the client side writing to it.
+func bufConnPair(tb testing.TB, prefix string) (net.Conn, *bufConn) {
+	client, server := tcpPair(tb)
+	if _, err := io.WriteString(client, prefix); err != nil {
+		tb.Fatal(err)
+	}
+	bufr := bufio.NewReader(server)
+	if _, err := bufr.Peek(len(prefix)); err != nil {
+		tb.Fatal(err)
+	}
+	return client, &bufConn{server, bufr}
+}
+
+func TestBufConnCopy(t *testing.T) {
+	srcClient, src := bufConnPair(t, "prefix:")
+	dstClient, dstServer := tcpPair(t)
+	dst := &bufConn{dstServer, nil}
+
+	go func() {
+		io.WriteString(srcClient, "payload")
+		srcClient.Close()
+	}()
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(dstClient)
+		done <- b
+	}()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstServer.(*net.TCPConn).CloseWrite()
+	if got := <-done; string(got) != "prefix:payload" || n != int64(len(got)) {
+		t.Fatalf("unexpected copy of %v bytes: %q", n, got)
+	}
+	if src.Unwrap() == nil || src.Buffered() != 0 {
+		t.Fatal("expected drained bufConn to unwrap to the raw connection")
+	}
+}
+
+func TestBufConnHalfClose(t *testing.T) {
+	client, bufc := bufConnPair(t, "ping\n")
+	defer client.Close()
+	defer bufc.Close()
+
+	if err := bufc.SetNoDelay(true); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(bufc, "pong\n")
+	if err := bufc.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(client); err != nil || string(b) != "pong\n" {
+		t.Fatalf("expected EOF after pong, got %q, %v", b, err)
+	}
+
+	// the read side remains open
+	client.Write([]byte("more\n"))
+	client.(*net.TCPConn).CloseWrite()
+	if b, err := io.ReadAll(bufc); err != nil || string(b) != "ping\nmore\n" {
+		t.Fatalf("unexpected read %q, %v", b, err)
+	}
+
+	pc, _ := net.Pipe()
+	defer pc.Close()
+	if err := (&bufConn{pc, nil}).CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected unsupported error, got %v", err)
+	}
+}
+
+// onlyReader and onlyWriter hide any io.WriterTo or io.ReaderFrom methods,
+// forcing io.Copy to copy through a userspace buffer.
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func benchmarkCopy(b *testing.B, userspace bool) {
+	const chunk = 64 * 1024
+	srcClient, src := bufConnPair(b, "prefix:")
+	dstClient, dstServer := tcpPair(b)
+	dst := &bufConn{dstServer, nil}
+	defer srcClient.Close()
+	defer dstClient.Close()
+	defer src.Close()
+	defer dst.Close()
+
+	go func() {
+		buf := bytes.Repeat([]byte{'x'}, chunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := srcClient.Write(buf); err != nil {
+				break
+			}
+		}
+		srcClient.(*net.TCPConn).CloseWrite()
+	}()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, dstClient)
+		close(done)
+	}()
+
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	var err error
+	if userspace {
+		_, err = io.Copy(onlyWriter{dst}, onlyReader{src})
+	} else {
+		_, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	dstServer.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// BenchmarkBufConnCopy copies between bufConns over TCP, which on Linux is
+// done in the kernel with splice(2) once the buffered prefix is drained.
+func BenchmarkBufConnCopy(b *testing.B) {
+	benchmarkCopy(b, false)
+}
+
+// BenchmarkBufConnCopyUserspace is BenchmarkBufConnCopy without the
+// io.WriterTo and io.ReaderFrom fast paths, for comparison.
+func BenchmarkBufConnCopyUserspace(b *testing.B) {
+	benchmarkCopy(b, true)
+}
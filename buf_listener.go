@@ -23,45 +23,124 @@ package stacked
 import (
 	"errors"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-var errBufListenerClosed = errors.New("bufListener closed")
+var (
+	errBufListenerClosed = errors.New("bufListener closed")
+	errBufListenerFull   = errors.New("bufListener queue full")
+)
 
-// bufListener implements net.Listener around a chan *bufConn.
+// bufListener implements net.Listener around a chan *bufConn.  The channel is
+// never closed, so that enqueueing can safely race with Close.
 type bufListener struct {
-	addr   net.Addr
-	conns  chan net.Conn
-	closed uint64
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	onDepth   func(addr net.Addr, depth int)
+	accepted  uint64
+	stopped   atomic.Bool // closed by the connBufShim, rather than its Serve
+
+	// successor replaces the listener once Serve closes it, guarded by the
+	// connBufShim's mu
+	successor *bufListener
 }
 
-func newBufListener(addr net.Addr) *bufListener {
+func newBufListener(addr net.Addr, queueSize int, onDepth func(net.Addr, int)) *bufListener {
 	return &bufListener{
-		addr:  addr,
-		conns: make(chan net.Conn),
+		addr:    addr,
+		conns:   make(chan net.Conn, queueSize),
+		done:    make(chan struct{}),
+		onDepth: onDepth,
+	}
+}
+
+// enqueue hands conn to Accept, waiting at most timeout (forever if zero)
+// for queue space or an Accept call.
+func (bl *bufListener) enqueue(conn net.Conn, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	if bl.isClosed() {
+		return errBufListenerClosed
 	}
+	select {
+	case bl.conns <- conn:
+	case <-bl.done:
+		return errBufListenerClosed
+	case <-expired:
+		return errBufListenerFull
+	}
+	if bl.isClosed() {
+		// lost a race with Close, make sure that conn doesn't linger
+		bl.drain()
+	} else {
+		bl.reportDepth()
+	}
+	return nil
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (bl *bufListener) Accept() (net.Conn, error) {
-	if bl.closed != 0 {
-		return nil, errBufListenerClosed
-	}
-	if conn := <-bl.conns; conn != nil {
+	select {
+	case conn := <-bl.conns:
+		atomic.AddUint64(&bl.accepted, 1)
+		bl.reportDepth()
 		return conn, nil
+	case <-bl.done:
+		return nil, errBufListenerClosed
 	}
-	return nil, errBufListenerClosed
 }
 
-// Close closes the listener.
+// Close closes the listener, and any connections still queued.
 func (bl *bufListener) Close() error {
-	if !atomic.CompareAndSwapUint64(&bl.closed, 0, 1) {
-		return nil
-	}
-	close(bl.conns)
+	bl.closeOnce.Do(func() {
+		close(bl.done)
+		bl.drain()
+	})
 	return nil
 }
 
+// stop closes the listener on the connBufShim's behalf, so that Serve
+// returning isn't a failure.
+func (bl *bufListener) stop() {
+	bl.stopped.Store(true)
+	bl.Close()
+}
+
+func (bl *bufListener) isClosed() bool {
+	select {
+	case <-bl.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (bl *bufListener) drain() {
+	for {
+		select {
+		case conn := <-bl.conns:
+			conn.Close()
+		default:
+			bl.reportDepth()
+			return
+		}
+	}
+}
+
+func (bl *bufListener) reportDepth() {
+	if bl.onDepth != nil {
+		bl.onDepth(bl.addr, len(bl.conns))
+	}
+}
+
 // Addr returns the listener's network address.
 func (bl *bufListener) Addr() net.Addr {
 	return bl.addr
@@ -0,0 +1,194 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultCandidateSampleSize is the default for Candidate.SampleSize.
+	DefaultCandidateSampleSize = 64
+
+	// candidateSamples is how many disagreements a Candidate keeps.
+	candidateSamples = 16
+)
+
+// Candidate is a Detector evaluated in shadow mode: alongside a Server's
+// live Detectors, on the same peeked bytes, to see how replacing one of them
+// would change detection, e.g. before tightening its Test.  Its decisions
+// are only recorded, and never acted on.  See Server.SetCandidates.
+//
+// A Candidate agrees if it matches exactly the connections that the live
+// Detector it would replace matches, whether that then wins them, or passes
+// them on by declining (see Decliner) or an ACL's Fallthrough.  Connections
+// won by Detectors earlier in the stack never reach it, so aren't evaluated.
+type Candidate struct {
+	// Name names the Candidate when logging.
+	Name string
+
+	// Detector is the candidate; only its Needed and Test are used.
+	Detector Detector
+
+	// Live is the index of the Detector that the Candidate would replace,
+	// among the Server's Detectors.
+	Live int
+
+	// SampleSize limits how many of the peeked bytes are kept as a sample
+	// of each disagreement; it defaults to DefaultCandidateSampleSize.
+	SampleSize int
+
+	// OnDisagree, if non-nil, is called for each disagreement, with whether
+	// the Candidate matched, and the sample of peeked bytes; otherwise
+	// disagreements are logged.
+	OnDisagree func(conn net.Conn, matched bool, sample []byte)
+
+	evaluated, short int64
+	extra, missed    int64
+
+	mu      sync.Mutex
+	samples []CandidateSample
+	next    int
+}
+
+// CandidateSample is a connection that a Candidate disagreed on.
+type CandidateSample struct {
+	Matched bool   // whether the Candidate matched, and the live one didn't
+	Prefix  []byte // a sample of the peeked bytes
+}
+
+// CandidateStats are a Candidate's counts so far.
+type CandidateStats struct {
+	// Evaluated is how many connections the Candidate was evaluated on.
+	Evaluated int64
+
+	// Short is how many connections it wasn't evaluated on, for too few
+	// bytes having been peeked for it when detection finished.
+	Short int64
+
+	// Extra is how many connections it matched but the live Detector
+	// didn't, and Missed how many the live Detector matched but it didn't.
+	Extra, Missed int64
+
+	// Samples are the most recent disagreements.
+	Samples []CandidateSample
+}
+
+// Stats returns the Candidate's counts so far.
+func (cand *Candidate) Stats() CandidateStats {
+	cand.mu.Lock()
+	samples := make([]CandidateSample, 0, len(cand.samples))
+	samples = append(samples, cand.samples[cand.next:]...)
+	samples = append(samples, cand.samples[:cand.next]...)
+	cand.mu.Unlock()
+	return CandidateStats{
+		Evaluated: atomic.LoadInt64(&cand.evaluated),
+		Short:     atomic.LoadInt64(&cand.short),
+		Extra:     atomic.LoadInt64(&cand.extra),
+		Missed:    atomic.LoadInt64(&cand.missed),
+		Samples:   samples,
+	}
+}
+
+// evaluate records what the candidate makes of peeked, given the index of
+// the live winner, or -1 if there was none, and of live Detectors that
+// matched but passed the connection on.
+func (cand *Candidate) evaluate(conn net.Conn, peeked []byte, winner int, passed []int) {
+	if winner >= 0 && winner < cand.Live {
+		return
+	}
+	if len(peeked) < cand.Detector.Needed {
+		atomic.AddInt64(&cand.short, 1)
+		return
+	}
+	atomic.AddInt64(&cand.evaluated, 1)
+	matched := cand.Detector.Test(peeked[:cand.Detector.Needed])
+	liveMatched := winner == cand.Live
+	for _, i := range passed {
+		liveMatched = liveMatched || i == cand.Live
+	}
+	if matched == liveMatched {
+		return
+	}
+	if matched {
+		atomic.AddInt64(&cand.extra, 1)
+	} else {
+		atomic.AddInt64(&cand.missed, 1)
+	}
+
+	size := cand.SampleSize
+	if size <= 0 {
+		size = DefaultCandidateSampleSize
+	}
+	if len(peeked) > size {
+		peeked = peeked[:size]
+	}
+	sample := CandidateSample{matched, append([]byte(nil), peeked...)}
+	cand.mu.Lock()
+	if len(cand.samples) < candidateSamples {
+		cand.samples = append(cand.samples, sample)
+	} else {
+		cand.samples[cand.next] = sample
+		cand.next = (cand.next + 1) % candidateSamples
+	}
+	cand.mu.Unlock()
+
+	if cand.OnDisagree != nil {
+		cand.OnDisagree(conn, matched, sample.Prefix)
+	} else if matched {
+		log.Printf("stacked: candidate %s matched, unlike live detector %d, on %q", cand.Name, cand.Live, sample.Prefix)
+	} else {
+		log.Printf("stacked: candidate %s didn't match, unlike live detector %d, on %q", cand.Name, cand.Live, sample.Prefix)
+	}
+}
+
+// SetCandidates replaces the Candidates evaluated on the Server's
+// connections, or removes them if none are given.  Candidate.Live refers to
+// the Server's current Detectors, so they should be set again after
+// SetDetectors.
+func (srv *Server) SetCandidates(cands ...*Candidate) {
+	if len(cands) == 0 {
+		srv.candidates.Store(nil)
+		return
+	}
+	cands = append([]*Candidate(nil), cands...)
+	srv.candidates.Store(&cands)
+}
+
+// evaluateCandidates evaluates any Candidates on the bytes peeked from the
+// connection, given the index of the live winner, or -1 if there was none,
+// and of live Detectors that matched but passed the connection on.
+func (srv *Server) evaluateCandidates(conn net.Conn, stack *detectorStack, bufr *bufio.Reader, winner int, passed []int) {
+	cands := srv.candidates.Load()
+	if cands == nil {
+		return
+	}
+	peeked, _ := bufr.Peek(bufr.Buffered())
+	for _, cand := range *cands {
+		if cand.Live >= 0 && cand.Live < len(stack.detectors) {
+			cand.evaluate(conn, peeked, winner, passed)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestCandidates(t *testing.T) {
+	srv := stacked.NewServer(
+		stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)),
+		stacked.FallthroughDetector(nameHandler("other")),
+	)
+	disagreed := make(chan bool, 10)
+	loose := &stacked.Candidate{
+		Name: "loose",
+		Detector: stacked.Detector{
+			Needed: 2,
+			Test:   func(b []byte) bool { return bytes.Equal(b, []byte("ec")) },
+		},
+		OnDisagree: func(conn net.Conn, matched bool, sample []byte) { disagreed <- matched },
+	}
+	srv.SetCandidates(loose)
+	addr := serveTestServer(t, srv).Addr().String()
+
+	for _, line := range []string{"echo 1", "ecru", "nope", "echo 2"} {
+		roundTrip(t, addr, line)
+	}
+	if matched := <-disagreed; !matched {
+		t.Fatal("expected the candidate to have matched")
+	}
+
+	stats := loose.Stats()
+	if stats.Evaluated != 4 || stats.Extra != 1 || stats.Missed != 0 || stats.Short != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(stats.Samples) != 1 || string(stats.Samples[0].Prefix) != "ecru\n" {
+		t.Fatalf("unexpected samples %+v", stats.Samples)
+	}
+
+	// connections won by earlier detectors aren't evaluated
+	later := &stacked.Candidate{Name: "later", Live: 1, Detector: stacked.Detector{
+		Needed: 1,
+		Test:   func(b []byte) bool { return b[0] != 'x' },
+	}}
+	srv.SetCandidates(later)
+	for _, line := range []string{"echo 1", "nope", "xyzzy"} {
+		roundTrip(t, addr, line)
+	}
+	if stats := later.Stats(); stats.Evaluated != 2 || stats.Missed != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCandidatesDeclined(t *testing.T) {
+	live := stacked.PrefixDetector("init", initHandler{})
+	srv := stacked.NewServer(live, stacked.FallthroughDetector(stacked.HandlerFunc(lineEcho)))
+	same := &stacked.Candidate{Name: "same", Detector: live}
+	srv.SetCandidates(same)
+	addr := serveTestServer(t, srv).Addr().String()
+
+	// a declined connection still matched the live detector
+	for _, line := range []string{"init bad", "init ok", "other"} {
+		roundTrip(t, addr, line)
+	}
+	if stats := same.Stats(); stats.Evaluated != 3 || stats.Extra != 0 || stats.Missed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
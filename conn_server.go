@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// ConnServer is implemented by downstream servers that can serve a single
+// connection directly, without needing a listener.  A Server is itself a
+// ConnServer.
+type ConnServer interface {
+	ServeConn(conn net.Conn)
+}
+
+// ConnServerFunc is a convenience type for adapting per-connection serving
+// functions, such as rpc.ServeConn or http2.Server.ServeConn, to ConnServer.
+type ConnServerFunc func(conn net.Conn)
+
+// ServeConn simply calls the function
+func (f ConnServerFunc) ServeConn(conn net.Conn) {
+	f(conn)
+}
+
+// ConnServerHandler creates a Handler that passes each connection straight to
+// srv.ServeConn, rather than through a listener as ListenServerHandler must.
+// The Handler starts, stops and closes srv along with the outer Server: a
+// nested Server like the Server it's nested in, and any other ConnServer if
+// it implements Starter, Stopper or io.Closer.
+func ConnServerHandler(srv ConnServer) Handler {
+	return &connServerShim{srv: srv}
+}
+
+// TLSConnServer is like TLSServer for a ConnServer: it returns a detector
+// that detects a client TLS handshake before wrapping each connection in
+// tls.Server to pass to srv.ServeConn.
+func TLSConnServer(config *tls.Config, srv ConnServer) Detector {
+	return Detector{
+		Needed:  minBytes,
+		Test:    isTLSClientHello,
+		Handler: &connServerShim{srv: srv, config: config},
+	}
+}
+
+// connServerShim implements Handler around a ConnServer, terminating TLS
+// first if it has a config.
+type connServerShim struct {
+	srv    ConnServer
+	config *tls.Config
+}
+
+// ServeConnection passes the connection to the ConnServer.
+func (cs *connServerShim) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	var c net.Conn = &bufConn{conn, bufr}
+	if cs.config != nil {
+		c = tls.Server(c, cs.config)
+	}
+	cs.srv.ServeConn(c)
+}
+
+// Start starts the ConnServer.
+func (cs *connServerShim) Start(ctx context.Context) error {
+	switch srv := cs.srv.(type) {
+	case *Server:
+		return srv.start(ctx)
+	case Starter:
+		return srv.Start(ctx)
+	}
+	return nil
+}
+
+// Stop stops the ConnServer, shutting down a nested Server, or closes it if
+// it can't be stopped.
+func (cs *connServerShim) Stop(ctx context.Context) error {
+	switch srv := cs.srv.(type) {
+	case *Server:
+		return srv.Shutdown(ctx)
+	case Stopper:
+		return srv.Stop(ctx)
+	case io.Closer:
+		return srv.Close()
+	}
+	return nil
+}
+
+// Close closes the ConnServer, or a nested Server's handlers.
+func (cs *connServerShim) Close() error {
+	switch srv := cs.srv.(type) {
+	case *Server:
+		return srv.closeDetectors()
+	case io.Closer:
+		return srv.Close()
+	}
+	return nil
+}
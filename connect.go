@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ConnectHandler implements Handler for HTTP CONNECT tunnels.  Once the
+// request has been accepted with a "200 Connection Established" response, the
+// tunneled stream is either served in-process by a Server, or forwarded on to
+// the requested target.
+type ConnectHandler struct {
+	// Local maps tunnel targets, as given in the request (e.g.
+	// "debug.local:80"), to Servers that handle them in-process.
+	Local map[string]*Server
+
+	// Dial connects to any target not in Local; if nil, then only Local
+	// targets are allowed.  It may forward to a fixed upstream rather than
+	// the requested address.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// ConnectDetector returns a Detector that detects HTTP CONNECT requests and
+// hands them to hndl.
+func ConnectDetector(hndl *ConnectHandler) Detector {
+	return PrefixDetector("CONNECT ", hndl)
+}
+
+// ServeConnection reads the CONNECT request, and then serves the tunnel.
+func (ch *ConnectHandler) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	req, err := http.ReadRequest(bufr)
+	if err != nil || req.Method != "CONNECT" {
+		connectRespond(conn, http.StatusBadRequest)
+		conn.Close()
+		return
+	}
+	target := req.Host
+
+	if srv, ok := ch.Local[target]; ok {
+		if err := connectRespond(conn, http.StatusOK); err != nil {
+			conn.Close()
+			return
+		}
+		srv.ServeConn(&bufConn{conn, bufr})
+		return
+	}
+
+	if ch.Dial == nil {
+		connectRespond(conn, http.StatusForbidden)
+		conn.Close()
+		return
+	}
+	upstream, err := ch.Dial("tcp", target)
+	if err != nil {
+		connectRespond(conn, http.StatusBadGateway)
+		conn.Close()
+		return
+	}
+	if err := connectRespond(conn, http.StatusOK); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	pipe(&bufConn{conn, bufr}, upstream)
+}
+
+// Start starts the handlers of all Local Servers.
+func (ch *ConnectHandler) Start(ctx context.Context) error {
+	var err error
+	for _, srv := range ch.Local {
+		err = errors.Join(err, srv.start(ctx))
+	}
+	return err
+}
+
+// Stop shuts down all Local Servers.
+func (ch *ConnectHandler) Stop(ctx context.Context) error {
+	var err error
+	for _, srv := range ch.Local {
+		err = errors.Join(err, srv.Shutdown(ctx))
+	}
+	return err
+}
+
+// Close closes the handlers of all Local Servers.
+func (ch *ConnectHandler) Close() error {
+	var err error
+	for _, srv := range ch.Local {
+		err = errors.Join(err, srv.closeDetectors())
+	}
+	return err
+}
+
+func connectRespond(conn net.Conn, code int) error {
+	if code == http.StatusOK {
+		_, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		return err
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+		code, http.StatusText(code))
+	return err
+}
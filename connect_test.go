@@ -0,0 +1,77 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+func connectTunnel(t *testing.T, addr, target string) (net.Conn, *bufio.Reader, int) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	bufr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(bufr, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufr, resp.StatusCode
+}
+
+func TestConnectDetector(t *testing.T) {
+	echoLn := serveTest(t, stacked.FallthroughDetector(stacked.HandlerFunc(lineEcho)))
+	defer echoLn.Close()
+
+	inner := stacked.NewServer(stacked.PrefixDetector("local", stacked.HandlerFunc(lineEcho)))
+	ln := serveTest(t, stacked.ConnectDetector(&stacked.ConnectHandler{
+		Local: map[string]*stacked.Server{"debug:80": inner},
+		Dial:  net.Dial,
+	}))
+	defer ln.Close()
+
+	for _, tt := range []struct {
+		target string
+		line   string
+	}{
+		{"debug:80", "local hello\n"},
+		{echoLn.Addr().String(), "remote hello\n"},
+	} {
+		conn, bufr, code := connectTunnel(t, ln.Addr().String(), tt.target)
+		if code != http.StatusOK {
+			t.Fatalf("CONNECT %v: unexpected status %v", tt.target, code)
+		}
+		io.WriteString(conn, tt.line)
+		if got, err := bufr.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if got != "> "+tt.line {
+			t.Fatalf("CONNECT %v: unexpected echo %q", tt.target, got)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	errDeclineConn = errors.New("stacked: connection can't be used before being accepted")
+	errPeekLimit   = errors.New("stacked: peeked past the detection buffer")
+)
+
+// accept has dec decide whether to take the connection, without consuming
+// anything from bufr.
+func (srv *Server) accept(dec Decliner, conn net.Conn, bufr *bufio.Reader) bool {
+	err := dec.Accept(declineConn{conn}, bufio.NewReaderSize(&peekReader{r: bufr}, bufr.Size()))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("stacked: handler declined connection from %v: %v", conn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+// peekReader reads from a bufio.Reader by peeking, consuming nothing.
+type peekReader struct {
+	r   *bufio.Reader
+	off int
+}
+
+// Read reads what's buffered past anything read so far, waiting to buffer
+// more if there's none.
+func (pr *peekReader) Read(b []byte) (int, error) {
+	n := pr.r.Buffered()
+	if n <= pr.off {
+		if pr.off >= pr.r.Size() {
+			return 0, errPeekLimit
+		}
+		n = pr.off + 1
+	}
+	p, err := pr.r.Peek(n)
+	if len(p) > pr.off {
+		n := copy(b, p[pr.off:])
+		pr.off += n
+		return n, nil
+	}
+	return 0, err
+}
+
+// declineConn is a net.Conn that can't be read, written or closed, given to
+// Decliners.
+type declineConn struct {
+	net.Conn
+}
+
+// Read fails.
+func (declineConn) Read(b []byte) (int, error) {
+	return 0, errDeclineConn
+}
+
+// Write fails.
+func (declineConn) Write(b []byte) (int, error) {
+	return 0, errDeclineConn
+}
+
+// Close fails.
+func (declineConn) Close() error {
+	return errDeclineConn
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestDecliner(t *testing.T) {
+	addr := serveTest(t,
+		stacked.PrefixDetector("init", initHandler{}),
+		stacked.FallthroughDetector(stacked.HandlerFunc(lineEcho)),
+	).Addr().String()
+
+	if got := roundTrip(t, addr, "init bad"); got != "> init bad" {
+		t.Fatalf("expected the declined connection unconsumed, got %q", got)
+	}
+	if got := roundTrip(t, addr, "init ok"); got != "accepted init ok" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
@@ -21,6 +21,9 @@
 package stacked
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 )
 
@@ -35,6 +38,23 @@ type Detector struct {
 	Test func(b []byte) bool
 
 	Handler Handler
+
+	// MaxConns, if non-zero, caps the connections being served by Handler;
+	// see Server.SetLimits.
+	MaxConns int
+
+	// RateLimit, if non-zero, limits how often each client can connect to
+	// Handler; see Limits.Rate.
+	RateLimit RateLimit
+
+	// ACL, if non-nil, decides which clients Handler may serve; see
+	// ACLRules.Fallthrough for what happens to the others.
+	ACL *ACL
+
+	// Reject, if non-nil, is called with connections that Handler can't
+	// take, e.g. over MaxConns, to respond in its protocol before they're
+	// closed.
+	Reject func(conn net.Conn, err error)
 }
 
 // DefaultHTTPHandler creates a FallthroughDetector around an http.Handler.
@@ -45,7 +65,22 @@ func DefaultHTTPHandler(hndl http.Handler) Detector {
 	handler := ListenServerHandler(&http.Server{
 		Handler: hndl,
 	})
-	return FallthroughDetector(handler)
+	det := FallthroughDetector(handler)
+	det.Reject = rejectHTTP
+	return det
+}
+
+// rejectHTTP responds 403 Forbidden to clients denied by an ACL, and 503
+// Service Unavailable to those over a limit.
+func rejectHTTP(conn net.Conn, err error) {
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, ErrDenied) {
+		status = http.StatusForbidden
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Connection: close\r\n\r\n"+
+		"%v\n", status, http.StatusText(status), err)
 }
 
 // FallthroughDetector returns a Detector whose Test function always returns
@@ -0,0 +1,76 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+
+	"github.com/uber-common/stacked"
+)
+
+type Arith struct{}
+
+func (Arith) Multiply(args [2]int, reply *int) error {
+	*reply = args[0] * args[1]
+	return nil
+}
+
+// ExampleConnServerHandler serves net/rpc's gob protocol next to HTTP, handing
+// each rpc connection straight to rpc.Server.ServeConn.
+func ExampleConnServerHandler() {
+	rpcSrv := rpc.NewServer()
+	must(rpcSrv.Register(Arith{}))
+
+	ln := mustListen(net.Listen("tcp", "127.0.0.1:0"))
+	defer ln.Close()
+	go stacked.NewServer(
+		// net/rpc clients start with a gob type definition, rather than
+		// an HTTP method
+		stacked.Detector{
+			Needed: 1,
+			Test:   func(b []byte) bool { return b[0] < 'A' },
+			Handler: stacked.ConnServerHandler(stacked.ConnServerFunc(
+				func(conn net.Conn) { rpcSrv.ServeConn(conn) })),
+		},
+		stacked.DefaultHTTPHandler(http.NotFoundHandler()),
+	).Serve(ln)
+
+	client, err := rpc.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	var product int
+	must(client.Call("Arith.Multiply", [2]int{6, 7}, &product))
+	fmt.Println(product)
+
+	// Output: 42
+}
+
+func mustListen(ln net.Listener, err error) net.Listener {
+	must(err)
+	return ln
+}
@@ -22,6 +22,7 @@ package stacked
 
 import (
 	"bufio"
+	"context"
 	"net"
 )
 
@@ -39,3 +40,31 @@ type HandlerFunc func(conn net.Conn, bufr *bufio.Reader)
 func (bchf HandlerFunc) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
 	bchf(conn, bufr)
 }
+
+// Starter is implemented by Handlers that need starting before a Server
+// accepts any connections, e.g. to start background work.  If Start fails,
+// Server.Serve returns its error without accepting.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper is implemented by Handlers that can be stopped gracefully, finishing
+// work in progress until ctx is done; see Server.Shutdown.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// Decliner is implemented by Handlers that may decline connections after
+// their Detector matched, once they've peeked at more of them, so that
+// detection carries on with later Detectors.
+//
+// Accept is called first, returning an error to decline the connection, or
+// nil to have it served.  It may only peek: bufr reads the connection
+// without consuming anything, as far as the Server's detection buffer
+// allows (at least 512 bytes, or the largest Detector.Needed), while conn
+// can't be read, written or closed.  Deadlines may be set on conn, but the
+// read deadline is cleared once Accept returns.
+type Decliner interface {
+	Handler
+	Accept(conn net.Conn, bufr *bufio.Reader) error
+}
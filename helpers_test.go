@@ -0,0 +1,232 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+// serveTest serves detectors on a local TCP port.
+func serveTest(t *testing.T, detectors ...stacked.Detector) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stacked.NewServer(detectors...).Serve(ln)
+	return ln
+}
+
+// serveTestServer is like serveTest for an existing Server, closing it once
+// the test is done.
+func serveTestServer(t *testing.T, srv *stacked.Server) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln
+}
+
+// listenLocal listens on a local TCP port.
+func listenLocal(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// lineEcho echoes each line back prefixed with "> ".
+func lineEcho(conn net.Conn, bufr *bufio.Reader) {
+	defer conn.Close()
+	for {
+		b, err := bufr.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(append([]byte("> "), b...)); err != nil {
+			return
+		}
+	}
+}
+
+// echoServer serves lineEcho, returning its listener and port.
+func echoServer(t *testing.T) (net.Listener, int) {
+	ln := serveTest(t, stacked.FallthroughDetector(stacked.HandlerFunc(lineEcho)))
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+// nameHandler answers each connection with name.
+func nameHandler(name string) stacked.Handler {
+	return stacked.HandlerFunc(func(conn net.Conn, bufr *bufio.Reader) {
+		io.WriteString(conn, name+"\n")
+		conn.Close()
+	})
+}
+
+// roundTrip sends line on a new connection to addr, returning the reply.
+func roundTrip(t *testing.T, addr, line string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, line+"\n")
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(got, "\n")
+}
+
+// echoConn is a connection to a lineEcho handler.
+type echoConn struct {
+	net.Conn
+	bufr *bufio.Reader
+}
+
+func dialEcho(t *testing.T, ln net.Listener) *echoConn {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &echoConn{conn, bufio.NewReader(conn)}
+}
+
+// echo sends line, returning the reply, or "" if none comes within timeout.
+func (ec *echoConn) echo(line string, timeout time.Duration) string {
+	io.WriteString(ec, line+"\n")
+	ec.SetReadDeadline(time.Now().Add(timeout))
+	got, _ := ec.bufr.ReadString('\n')
+	return got
+}
+
+// lifecycleHandler records Start and Stop calls, failing Start with err.
+type lifecycleHandler struct {
+	stacked.HandlerFunc
+	err      error
+	started  atomic.Bool
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newLifecycleHandler(err error) *lifecycleHandler {
+	return &lifecycleHandler{HandlerFunc: lineEcho, err: err, stopped: make(chan struct{})}
+}
+
+func (lh *lifecycleHandler) Start(ctx context.Context) error {
+	lh.started.Store(lh.err == nil)
+	return lh.err
+}
+
+func (lh *lifecycleHandler) Stop(ctx context.Context) error {
+	lh.stopOnce.Do(func() { close(lh.stopped) })
+	return nil
+}
+
+// addrServer answers each connection with the address of the listener that
+// it was accepted from, counting Serve calls.
+type addrServer struct {
+	serves atomic.Int32
+}
+
+func (as *addrServer) Serve(ln net.Listener) error {
+	as.serves.Add(1)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		io.WriteString(conn, ln.Addr().String()+"\n")
+		conn.Close()
+	}
+}
+
+// initHandler takes connections starting with an "init ok" line.
+type initHandler struct{}
+
+func (initHandler) Accept(conn net.Conn, bufr *bufio.Reader) error {
+	if _, err := io.WriteString(conn, "too soon\n"); err == nil {
+		return errors.New("wrote before accepting")
+	}
+	line, err := bufr.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != "init ok\n" {
+		return fmt.Errorf("bad init line %q", line)
+	}
+	return nil
+}
+
+func (initHandler) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	defer conn.Close()
+	line, _ := bufr.ReadString('\n')
+	io.WriteString(conn, "accepted "+line)
+}
+
+// startChild runs TestActivationChild in a child process, passing it lns as
+// file descriptors 3 onwards, and closing them in this process.
+func startChild(t *testing.T, mode string, env []string, lns ...net.Listener) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationChild$")
+	cmd.Env = append(os.Environ(), "STACKED_TEST_CHILD="+mode)
+	cmd.Env = append(cmd.Env, env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second // in case a grandchild holds stderr open
+	for _, ln := range lns {
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		ln.Close()
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("child stderr:\n%s", stderr.String())
+		}
+	})
+	return cmd
+}
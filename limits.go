@@ -0,0 +1,338 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Errors passed to a Detector's Reject function, and Limits.OnReject.
+var (
+	// ErrTooManyConns is for connections over a connection limit.
+	ErrTooManyConns = errors.New("stacked: too many connections")
+
+	// ErrRateLimited is for connections over a rate limit.
+	ErrRateLimited = errors.New("stacked: connection rate limited")
+)
+
+// Limits caps the concurrent connections of a Server; zero fields mean no
+// limit.  See Server.SetLimits, and Detector.MaxConns for per-Detector
+// limits.
+type Limits struct {
+	// MaxConns caps the connections that are open; at the cap, Serve stops
+	// accepting until one is closed.
+	MaxConns int
+
+	// MaxDetecting caps the connections whose protocol is still being
+	// detected; at the cap, Serve stops accepting until detection finishes
+	// for one.
+	MaxDetecting int
+
+	// MaxConnsPerIP caps the open connections from each client IP; any more
+	// are closed before detection.
+	MaxConnsPerIP int
+
+	// Rate limits how often each client can connect; any more connections
+	// are closed before detection.  Clients are keyed by IP prefix, see
+	// IPv4Prefix and IPv6Prefix; Detector.RateLimit adds limits per
+	// Detector.
+	Rate RateLimit
+
+	// IPv4Prefix and IPv6Prefix are how many bits of client IPs key rate
+	// limits, e.g. 24 to limit IPv4 /24 networks as one; zero means whole
+	// addresses.
+	IPv4Prefix, IPv6Prefix int
+
+	// MaxRateKeys bounds how many keys rate limits are kept for, evicting
+	// the least recently used ones, which then start afresh; it defaults to
+	// DefaultMaxRateKeys.
+	MaxRateKeys int
+
+	// OnReject, if non-nil, is called with each connection closed or
+	// rejected over a limit, and the Detector that it matched, if any.
+	OnReject func(conn net.Conn, det *Detector, err error)
+}
+
+// DefaultMaxRateKeys is the default for Limits.MaxRateKeys.
+const DefaultMaxRateKeys = 65536
+
+// ConnStats are a Server's current connection counts.
+type ConnStats struct {
+	// Conns counts open connections, and Detecting those among them whose
+	// protocol is still being detected.
+	Conns, Detecting int
+
+	// Detectors counts the connections being served by each Detector, in
+	// order.
+	Detectors []int
+}
+
+// SetLimits sets the Server's connection limits, taking effect for new
+// connections.  Setting any limits, even zero ones, starts counting
+// connections for Stats; so does a Detector with MaxConns.
+//
+// Connections are counted until closed, so handlers mustn't hand them off
+// without eventually closing them.  Connections passed to ServeConn are
+// closed, rather than waited for, when over MaxConns or MaxDetecting.
+func (srv *Server) SetLimits(limits Limits) {
+	srv.limiter.set(limits)
+}
+
+// Stats returns the Server's current connection counts, which are only kept
+// once limits are set; see SetLimits.
+func (srv *Server) Stats() ConnStats {
+	return srv.limiter.stats(srv.stack.Load())
+}
+
+// ConnsFrom returns the number of open connections from a client IP, which
+// is only kept once limits are set; see SetLimits.
+func (srv *Server) ConnsFrom(ip net.IP) int {
+	return srv.limiter.connsFrom(ip.String())
+}
+
+// connLimiter counts connections to enforce Limits and Detector.MaxConns.
+type connLimiter struct {
+	mu        sync.Mutex
+	tracking  bool
+	limits    Limits
+	conns     int
+	detecting int
+	perIP     map[string]int
+	buckets   rateBuckets
+	freed     chan struct{} // closed and replaced when conns or detecting drop
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{freed: make(chan struct{})}
+}
+
+// track starts tracking if any of detectors have limits.
+func (cl *connLimiter) track(detectors []Detector) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for _, det := range detectors {
+		if det.MaxConns > 0 || det.RateLimit.Rate > 0 {
+			cl.tracking = true
+		}
+	}
+}
+
+func (cl *connLimiter) set(limits Limits) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.tracking = true
+	cl.limits = limits
+	cl.wake()
+}
+
+func (cl *connLimiter) stats(stack *detectorStack) ConnStats {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return ConnStats{
+		Conns:     cl.conns,
+		Detecting: cl.detecting,
+		Detectors: stack.conns(),
+	}
+}
+
+func (cl *connLimiter) connsFrom(ip string) int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.perIP[ip]
+}
+
+// rejected calls any OnReject hook.
+func (cl *connLimiter) rejected(conn net.Conn, det *Detector, err error) {
+	cl.mu.Lock()
+	onReject := cl.limits.OnReject
+	cl.mu.Unlock()
+	if onReject != nil {
+		onReject(conn, det, err)
+	}
+}
+
+// rateOK takes a token from the bucket of limit for a client IP and a
+// Detector's state (or nil for none), returning false if there are none.
+func (cl *connLimiter) rateOK(ip string, state *detectorState, limit RateLimit) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	max := cl.limits.MaxRateKeys
+	if max <= 0 {
+		max = DefaultMaxRateKeys
+	}
+	key := rateKey{
+		prefix: ipPrefix(ip, cl.limits.IPv4Prefix, cl.limits.IPv6Prefix),
+		det:    state,
+	}
+	return cl.buckets.take(key, limit, max, time.Now())
+}
+
+// wake wakes any admit calls waiting for room.
+func (cl *connLimiter) wake() {
+	close(cl.freed)
+	cl.freed = make(chan struct{})
+}
+
+func (cl *connLimiter) full() bool {
+	return (cl.limits.MaxConns > 0 && cl.conns >= cl.limits.MaxConns) ||
+		(cl.limits.MaxDetecting > 0 && cl.detecting >= cl.limits.MaxDetecting)
+}
+
+// wait waits for room for a new connection, without counting one, returning
+// false if done is closed first.
+func (cl *connLimiter) wait(done <-chan struct{}) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.waitLocked(done)
+}
+
+// waitLocked waits for room, returning false if done is closed first, or at
+// once if done is nil.
+func (cl *connLimiter) waitLocked(done <-chan struct{}) bool {
+	for cl.tracking && cl.full() {
+		if done == nil {
+			return false
+		}
+		freed := cl.freed
+		cl.mu.Unlock()
+		select {
+		case <-freed:
+			cl.mu.Lock()
+		case <-done:
+			cl.mu.Lock()
+			return false
+		}
+	}
+	return true
+}
+
+// admit counts a new connection as open and detecting, returning its ticket,
+// which is nil when not tracking.  When full, it waits for room until done is
+// closed, or returns false at once if done is nil.
+func (cl *connLimiter) admit(done <-chan struct{}) (*connTicket, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if !cl.waitLocked(done) {
+		return nil, false
+	}
+	if !cl.tracking {
+		return nil, true
+	}
+	cl.conns++
+	cl.detecting++
+	return &connTicket{cl: cl, detecting: true}, true
+}
+
+// connTicket is what a connection holds of a connLimiter's counts.
+type connTicket struct {
+	cl        *connLimiter
+	client    string         // client IP
+	perIP     bool           // whether counted in perIP
+	det       *detectorState // of the matched Detector, if any
+	detecting bool
+	once      sync.Once
+}
+
+// from counts the connection for its client IP, returning an error if that's
+// over MaxConnsPerIP or Rate.
+func (t *connTicket) from(addr net.Addr) error {
+	ip := clientIP(addr)
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.client = ip
+	if !t.cl.rateOK(ip, nil, t.cl.limits.Rate) {
+		return ErrRateLimited
+	}
+	if ip == "" {
+		return nil
+	}
+	if max := t.cl.limits.MaxConnsPerIP; max > 0 && t.cl.perIP[ip] >= max {
+		return ErrTooManyConns
+	}
+	if t.cl.perIP == nil {
+		t.cl.perIP = make(map[string]int)
+	}
+	t.cl.perIP[ip]++
+	t.perIP = true
+	return nil
+}
+
+// detected ends detection, counting the connection for the i'th Detector of
+// stack, unless that's over its MaxConns or RateLimit.
+func (t *connTicket) detected(stack *detectorStack, i int, det *Detector) error {
+	t.cl.mu.Lock()
+	defer t.cl.mu.Unlock()
+	t.endDetection()
+	state := stack.states[i]
+	if det.MaxConns > 0 && state.conns >= det.MaxConns {
+		return ErrTooManyConns
+	}
+	if !t.cl.rateOK(t.client, state, det.RateLimit) {
+		return ErrRateLimited
+	}
+	state.conns++
+	t.det = state
+	return nil
+}
+
+func (t *connTicket) endDetection() {
+	if t.detecting {
+		t.detecting = false
+		t.cl.detecting--
+		t.cl.wake()
+	}
+}
+
+// release uncounts the connection, once it's closed.
+func (t *connTicket) release() {
+	t.once.Do(func() {
+		t.cl.mu.Lock()
+		defer t.cl.mu.Unlock()
+		t.endDetection()
+		t.cl.conns--
+		if t.perIP {
+			if t.cl.perIP[t.client]--; t.cl.perIP[t.client] == 0 {
+				delete(t.cl.perIP, t.client)
+			}
+		}
+		if t.det != nil {
+			t.det.conns--
+		}
+		t.cl.wake()
+	})
+}
+
+// limitedConn releases its connTicket once closed.
+type limitedConn struct {
+	bufConn
+	ticket *connTicket
+}
+
+// Close closes the connection, and uncounts it.
+func (lc *limitedConn) Close() error {
+	err := lc.bufConn.Close()
+	lc.ticket.release()
+	return err
+}
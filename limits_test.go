@@ -0,0 +1,214 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestLimitsMaxConns(t *testing.T) {
+	srv := stacked.NewServer(stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	srv.SetLimits(stacked.Limits{MaxConns: 2})
+	ln := serveTestServer(t, srv)
+
+	first, second := dialEcho(t, ln), dialEcho(t, ln)
+	for _, ec := range []*echoConn{first, second} {
+		if got := ec.echo("echo hi", time.Second); got != "> echo hi\n" {
+			t.Fatalf("unexpected echo %q", got)
+		}
+	}
+	if stats := srv.Stats(); stats.Conns != 2 || stats.Detecting != 0 || stats.Detectors[0] != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// accepting is paused until a connection closes
+	third := dialEcho(t, ln)
+	if got := third.echo("echo paused", 50*time.Millisecond); got != "" {
+		t.Fatalf("expected no echo while paused, got %q", got)
+	}
+	first.Close()
+	if got := third.echo("echo resumed", time.Second); got != "> echo paused\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}
+
+func TestLimitsServeConn(t *testing.T) {
+	rejected := make(chan error, 1)
+	srv := stacked.NewServer(stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	srv.SetLimits(stacked.Limits{
+		MaxConns: 1,
+		OnReject: func(conn net.Conn, det *stacked.Detector, err error) { rejected <- err },
+	})
+	defer srv.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(server)
+	ec := &echoConn{client, bufio.NewReader(client)}
+	if got := ec.echo("echo hi", time.Second); got != "> echo hi\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+
+	// ServeConn can't wait for room, so it closes the connection at once
+	client, server = net.Pipe()
+	defer client.Close()
+	srv.ServeConn(server)
+	select {
+	case err := <-rejected:
+		if err != stacked.ErrTooManyConns {
+			t.Fatalf("expected ErrTooManyConns, got %v", err)
+		}
+	default:
+		t.Fatal("OnReject wasn't called")
+	}
+}
+
+func TestLimitsIdleListener(t *testing.T) {
+	srv := stacked.NewServer(stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	srv.SetLimits(stacked.Limits{MaxConns: 1})
+	ln := serveTestServer(t, srv)
+	first := dialEcho(t, ln)
+	if got := first.echo("echo hi", time.Second); got != "> echo hi\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	first.Close()
+	for deadline := time.Now().Add(time.Second); srv.Stats().Conns != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection never uncounted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// an accept loop waiting for connections doesn't count as one
+	time.Sleep(10 * time.Millisecond)
+	if stats := srv.Stats(); stats.Conns != 0 || stats.Detecting != 0 {
+		t.Fatalf("expected idle stats, got %+v", stats)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(server)
+	ec := &echoConn{client, bufio.NewReader(client)}
+	if got := ec.echo("echo piped", time.Second); got != "> echo piped\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}
+
+func TestLimitsPerDetector(t *testing.T) {
+	admin := stacked.PrefixDetector("admin", stacked.HandlerFunc(lineEcho))
+	admin.MaxConns = 1
+	admin.Reject = func(conn net.Conn, err error) {
+		io.WriteString(conn, "busy\n")
+	}
+	srv := stacked.NewServer(admin, stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	ln := serveTestServer(t, srv)
+
+	if got := dialEcho(t, ln).echo("admin one", time.Second); got != "> admin one\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	if got := dialEcho(t, ln).echo("admin two", time.Second); got != "busy\n" {
+		t.Fatalf("expected rejection, got %q", got)
+	}
+	if got := dialEcho(t, ln).echo("echo other", time.Second); got != "> echo other\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	if stats := srv.Stats(); stats.Detectors[0] != 1 || stats.Detectors[1] != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLimitsRejectHTTP(t *testing.T) {
+	det := stacked.DefaultHTTPHandler(http.NotFoundHandler())
+	det.MaxConns = 1
+	ln := serveTestServer(t, stacked.NewServer(det))
+
+	req := "GET / HTTP/1.1\r\nHost: test\r\n\r"
+	if got := dialEcho(t, ln).echo(req, time.Second); got != "HTTP/1.1 404 Not Found\r\n" {
+		t.Fatalf("expected 404, got %q", got)
+	}
+	// the first connection is kept alive, so the next is over MaxConns
+	if got := dialEcho(t, ln).echo(req, time.Second); got != "HTTP/1.1 503 Service Unavailable\r\n" {
+		t.Fatalf("expected 503, got %q", got)
+	}
+}
+
+func TestLimitsPerIP(t *testing.T) {
+	srv := stacked.NewServer(stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	srv.SetLimits(stacked.Limits{MaxConnsPerIP: 1})
+	ln := serveTestServer(t, srv)
+
+	first := dialEcho(t, ln)
+	if got := first.echo("echo hi", time.Second); got != "> echo hi\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	if got := dialEcho(t, ln).echo("echo again", time.Second); got != "" {
+		t.Fatalf("expected second connection to be closed, got %q", got)
+	}
+	if n := srv.ConnsFrom(net.IPv4(127, 0, 0, 1)); n != 1 {
+		t.Fatalf("expected 1 connection from localhost, got %d", n)
+	}
+}
+
+func TestLimitsRate(t *testing.T) {
+	admin := stacked.PrefixDetector("admin", stacked.HandlerFunc(lineEcho))
+	admin.RateLimit = stacked.RateLimit{Rate: 0.001}
+	admin.Reject = func(conn net.Conn, err error) {
+		io.WriteString(conn, err.Error()+"\n")
+	}
+	srv := stacked.NewServer(admin, stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	rejects := make(chan error, 10)
+	srv.SetLimits(stacked.Limits{
+		Rate: stacked.RateLimit{Rate: 0.001, Burst: 3},
+		OnReject: func(conn net.Conn, det *stacked.Detector, err error) {
+			if det != nil {
+				err = fmt.Errorf("%v by detector", err)
+			}
+			rejects <- err
+		},
+	})
+	ln := serveTestServer(t, srv)
+
+	if got := dialEcho(t, ln).echo("admin one", time.Second); got != "> admin one\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	if got := dialEcho(t, ln).echo("admin two", time.Second); got != stacked.ErrRateLimited.Error()+"\n" {
+		t.Fatalf("expected admin rate limit, got %q", got)
+	}
+	if err := <-rejects; err.Error() != stacked.ErrRateLimited.Error()+" by detector" {
+		t.Fatalf("unexpected rejection %v", err)
+	}
+	if got := dialEcho(t, ln).echo("echo three", time.Second); got != "> echo three\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	if got := dialEcho(t, ln).echo("echo four", time.Second); got != "" {
+		t.Fatalf("expected client rate limit, got %q", got)
+	}
+	if err := <-rejects; err != stacked.ErrRateLimited {
+		t.Fatalf("unexpected rejection %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ListenOptions tunes the TCP listeners opened by Listen and
+// Server.ListenAndServeOptions; the zero value opens a single listener with
+// Go's defaults.
+type ListenOptions struct {
+	// ReusePort opens this many listeners per address with SO_REUSEPORT,
+	// each served by its own accept loop, so that the kernel spreads new
+	// connections across them; Linux only.
+	ReusePort int
+
+	// Backlog is the length of the queue of connections waiting to be
+	// accepted, instead of the system default; Linux only.
+	Backlog int
+
+	// DeferAccept sets TCP_DEFER_ACCEPT, so that a connection is only
+	// accepted once the client has sent data, or after about this long;
+	// Linux only.
+	DeferAccept time.Duration
+
+	// KeepAlive is the keep-alive period for accepted connections, as for
+	// net.ListenConfig: zero means Go's default, and negative disables
+	// keep-alives.
+	KeepAlive time.Duration
+
+	// DisableNoDelay leaves Nagle's algorithm enabled for accepted
+	// connections, rather than setting TCP_NODELAY as Go does by default.
+	DisableNoDelay bool
+}
+
+func (opts ListenOptions) listenTCP(addr string) ([]net.Listener, error) {
+	lc := net.ListenConfig{
+		KeepAlive: opts.KeepAlive,
+		Control:   opts.control,
+	}
+	n := 1
+	if opts.ReusePort > 1 {
+		n = opts.ReusePort
+	}
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err == nil && opts.Backlog > 0 {
+			if err = setBacklog(ln.(*net.TCPListener), opts.Backlog); err != nil {
+				ln.Close()
+			}
+		}
+		if err != nil {
+			closeListeners(lns)
+			return nil, err
+		}
+		if i == 0 {
+			// e.g. for port 0, the rest must share the port picked for the
+			// first
+			addr = ln.Addr().String()
+		}
+		if opts.DisableNoDelay {
+			ln = delayListener{ln.(*net.TCPListener)}
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// delayListener disables TCP_NODELAY on accepted connections.
+type delayListener struct {
+	*net.TCPListener
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (dl delayListener) Accept() (net.Conn, error) {
+	conn, err := dl.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetNoDelay(false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
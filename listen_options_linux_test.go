@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/uber-common/stacked"
+)
+
+func sockopt(t *testing.T, sc syscall.Conn, level, opt int) int {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var val int
+	rc.Control(func(fd uintptr) {
+		val, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+func TestListenOptions(t *testing.T) {
+	lns, err := stacked.Listen("127.0.0.1:0", stacked.ListenOptions{
+		ReusePort:      4,
+		Backlog:        16,
+		DeferAccept:    time.Second,
+		DisableNoDelay: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 4 {
+		t.Fatalf("expected 4 listeners, got %d", len(lns))
+	}
+	addr := lns[0].Addr().String()
+	for _, ln := range lns {
+		if ln.Addr().String() != addr {
+			t.Fatalf("expected all listeners on %v, got %v", addr, ln.Addr())
+		}
+		if sockopt(t, ln.(syscall.Conn), unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT) == 0 {
+			t.Fatalf("expected TCP_DEFER_ACCEPT on %v", ln.Addr())
+		}
+	}
+
+	noDelay := make(chan int, 1)
+	as := &addrServer{}
+	srv := stacked.NewServer(
+		stacked.PrefixDetector("nodelay", stacked.HandlerFunc(func(conn net.Conn, bufr *bufio.Reader) {
+			noDelay <- sockopt(t, conn.(syscall.Conn), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+			conn.Close()
+		})),
+		stacked.FallthroughDetector(stacked.ListenServerHandler(as)),
+	)
+	go srv.ServeAll(lns...)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "nodelay?")
+	if val := <-noDelay; val != 0 {
+		t.Fatalf("expected TCP_NODELAY to be off, got %d", val)
+	}
+	conn.Close()
+
+	// the kernel spreads connections across the listeners, each of which
+	// gets its own virtual listener
+	for i := 0; i < 40; i++ {
+		if got := roundTrip(t, addr, "which?"); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	if n := as.serves.Load(); n < 2 {
+		t.Fatalf("expected connections on several listeners, got %d", n)
+	}
+}
@@ -22,7 +22,13 @@ package stacked
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ListenServer is the minimal downstream server interface, e.g. implemented by
@@ -33,48 +39,340 @@ type ListenServer interface {
 
 // ListenServerHandler creates a compatibility Handler for
 func ListenServerHandler(srv ListenServer) Handler {
-	return &connBufShim{Server: srv}
+	return ListenServerHandlerOptions(srv, ListenServerOptions{})
 }
 
+// ListenServerHandlerOptions is like ListenServerHandler, but with explicit
+// handoff options.
+func ListenServerHandlerOptions(srv ListenServer, opts ListenServerOptions) Handler {
+	return &connBufShim{Server: srv, ListenServerOptions: opts}
+}
+
+// ListenServerOptions configures how connections are handed off to a
+// ListenServer; the zero value hands each one directly to an Accept call,
+// waiting as long as that takes.
+type ListenServerOptions struct {
+	// QueueSize is how many connections may wait for the ListenServer to
+	// Accept them, per listener.
+	QueueSize int
+
+	// EnqueueTimeout bounds how long a connection waits for queue space (or
+	// an Accept call when QueueSize is zero); zero means waiting forever.
+	EnqueueTimeout time.Duration
+
+	// Overflow decides what happens once EnqueueTimeout passes.
+	Overflow OverflowPolicy
+
+	// OnQueueDepth, if non-nil, is called with the number of queued
+	// connections for a listener whenever that changes.
+	OnQueueDepth func(addr net.Addr, depth int)
+
+	// OnServeError, if non-nil, is called whenever the ListenServer's Serve
+	// returns an error.
+	OnServeError func(addr net.Addr, err error)
+
+	// Restart decides how the ListenServer is restarted after Serve
+	// returns an error.
+	Restart RestartPolicy
+
+	// Critical marks the ListenServer as essential: rather than being
+	// restarted, its first Serve error causes any Server.Serve running this
+	// handler to close its listener and return that error.
+	Critical bool
+}
+
+// RestartPolicy decides how a ListenServer is restarted after its Serve
+// returns an error.  While it's down, connections wait in its queue as usual.
+type RestartPolicy struct {
+	// MaxRestarts is how many consecutive restarts to try before giving up,
+	// after which connections are closed; zero means no limit, and a
+	// negative value never restarts.  Restarts stop being consecutive once
+	// a connection is accepted.
+	MaxRestarts int
+
+	// MinBackoff and MaxBackoff bound the delay before each restart, which
+	// doubles with each consecutive one; they default to
+	// DefaultMinRestartBackoff and DefaultMaxRestartBackoff.
+	MinBackoff, MaxBackoff time.Duration
+}
+
+// Defaults used by a RestartPolicy for any zero-valued backoffs.
+const (
+	DefaultMinRestartBackoff = 5 * time.Millisecond
+	DefaultMaxRestartBackoff = time.Second
+)
+
+// OverflowPolicy decides what happens to a connection that a ListenServer
+// doesn't take within its EnqueueTimeout.
+type OverflowPolicy int
+
+const (
+	// OverflowReject closes the connection, leaving the ListenServer
+	// running for the next one.
+	OverflowReject OverflowPolicy = iota
+
+	// OverflowClose additionally closes the listener, so that the
+	// ListenServer's Serve returns; a fresh listener and Serve call are
+	// started for the next connection.  This suits ListenServers that may
+	// stop accepting, rather than just being slow.
+	OverflowClose
+)
+
 // connBufShim implements Handler interface around a ListenServer
 type connBufShim struct {
-	Server    ListenServer
-	listeners map[net.Addr]*bufListener
+	Server ListenServer
+	ListenServerOptions
+	mu        sync.Mutex
+	closed    bool
+	listeners map[any]*bufListener // by Server listener, or addrKey
+
+	err      error         // why the ListenServer was given up on
+	dead     chan struct{} // closed once err is set
+	deadOnce sync.Once
+}
+
+// addrKey identifies a local address by value, since the net.Addrs of
+// different connections to the same address are distinct pointers.
+type addrKey struct {
+	network, addr string
+}
+
+func keyForAddr(addr net.Addr) addrKey {
+	if addr == nil {
+		return addrKey{}
+	}
+	return addrKey{addr.Network(), addr.String()}
 }
 
 // ServeConnection simply puts a new bufConn onto bufConns for distribution by
 // bufLn.Accept.
 func (cbs *connBufShim) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
-	cbs.lnFor(conn).conns <- &bufConn{conn, bufr}
+	cbs.handoff(nil, &bufConn{conn, bufr})
+}
+
+func (cbs *connBufShim) serveListenerConnection(ln net.Listener, conn net.Conn, bufr *bufio.Reader) {
+	cbs.handoff(ln, &bufConn{conn, bufr})
+}
+
+// closeListener closes the bufListener for a Server listener, so that the
+// ListenServer's Serve for it returns.
+func (cbs *connBufShim) closeListener(ln net.Listener) {
+	cbs.mu.Lock()
+	defer cbs.mu.Unlock()
+	if bl := cbs.listeners[ln]; bl != nil {
+		bl.stop()
+		delete(cbs.listeners, ln)
+	}
 }
 
-// lnFor gets or creates the bufListener for connection (one-per
-// conn.LocalAddr()).
-func (cbs *connBufShim) lnFor(conn net.Conn) *bufListener {
-	addr := conn.LocalAddr()
+// handoff queues conn, accepted from ln if that's non-nil, on its
+// bufListener, closing it if it can't be queued in time.
+func (cbs *connBufShim) handoff(from net.Listener, conn net.Conn) {
+	ln := cbs.lnFor(from, conn)
+	if ln == nil {
+		conn.Close()
+		return
+	}
+	switch err := ln.enqueue(conn, cbs.EnqueueTimeout); err {
+	case nil:
+	case errBufListenerFull:
+		conn.Close()
+		if cbs.Overflow == OverflowClose {
+			ln.stop()
+		}
+	default:
+		conn.Close()
+	}
+}
+
+// lnFor gets or creates the bufListener for connection: one per Server
+// listener it came from, or else per conn.LocalAddr().  It returns nil once
+// the shim is closed.
+func (cbs *connBufShim) lnFor(from net.Listener, conn net.Conn) *bufListener {
+	var (
+		key  any
+		addr net.Addr
+	)
+	if from != nil {
+		key, addr = from, from.Addr()
+	} else {
+		addr = conn.LocalAddr()
+		key = keyForAddr(addr)
+	}
+	cbs.mu.Lock()
+	defer cbs.mu.Unlock()
+	if cbs.closed || cbs.err != nil {
+		return nil
+	}
 	if cbs.listeners == nil {
-		cbs.listeners = make(map[net.Addr]*bufListener, 1)
+		cbs.listeners = make(map[any]*bufListener, 1)
 	}
-	if ln := cbs.listeners[addr]; ln != nil {
+	if ln := cbs.listeners[key]; ln != nil && !ln.stopped.Load() {
+		if ln.isClosed() {
+			// Serve closed it, and is being restarted
+			return cbs.renewLocked(key, ln)
+		}
 		return ln
 	}
-	ln := newBufListener(addr)
-	cbs.listeners[addr] = ln
-	go func() {
-		if err := cbs.Server.Serve(ln); err != nil {
-			delete(cbs.listeners, addr)
+	ln := newBufListener(addr, cbs.QueueSize, cbs.OnQueueDepth)
+	cbs.listeners[key] = ln
+	go cbs.supervise(key, ln)
+	return ln
+}
+
+// renewLocked returns the successor of a bufListener that Serve closed,
+// creating it in its place if need be, or nil if it's no longer in use.
+func (cbs *connBufShim) renewLocked(key any, ln *bufListener) *bufListener {
+	if cbs.closed || cbs.err != nil {
+		return nil
+	}
+	if ln.successor == nil {
+		if cbs.listeners[key] != ln {
+			return nil
+		}
+		ln.successor = newBufListener(ln.addr, cbs.QueueSize, cbs.OnQueueDepth)
+		cbs.listeners[key] = ln.successor
+	}
+	return ln.successor
+}
+
+// supervise runs the ListenServer on ln, restarting it as dictated by the
+// RestartPolicy, on a fresh bufListener if Serve closed ln; it returns once
+// the shim closes ln or the ListenServer is given up on.
+func (cbs *connBufShim) supervise(key any, ln *bufListener) {
+	defer func() {
+		cbs.mu.Lock()
+		var lns []*bufListener
+		for l := ln; l != nil; l = l.successor {
+			lns = append(lns, l)
+			if cbs.listeners[key] == l {
+				delete(cbs.listeners, key)
+			}
+		}
+		cbs.mu.Unlock()
+		for _, l := range lns {
+			l.stop()
 		}
 	}()
-	return ln
+
+	policy := cbs.Restart
+	var (
+		restarts int
+		backoff  time.Duration
+		accepted uint64
+	)
+	for {
+		err := cbs.Server.Serve(ln)
+		if err == nil || ln.stopped.Load() {
+			return
+		}
+		if cbs.OnServeError != nil {
+			cbs.OnServeError(ln.Addr(), err)
+		}
+
+		if n := atomic.LoadUint64(&ln.accepted); n != accepted {
+			accepted, restarts, backoff = n, 0, 0
+		}
+		if cbs.Critical || policy.MaxRestarts < 0 ||
+			(policy.MaxRestarts > 0 && restarts >= policy.MaxRestarts) {
+			log.Printf("stacked: giving up on ListenServer for %v: %v", ln.Addr(), err)
+			cbs.fail(err)
+			return
+		}
+		restarts++
+
+		if ln.isClosed() {
+			// connections wait on a fresh listener while restarting
+			cbs.mu.Lock()
+			next := cbs.renewLocked(key, ln)
+			cbs.mu.Unlock()
+			if next == nil {
+				return
+			}
+			ln, accepted = next, 0
+		}
+
+		if backoff == 0 {
+			backoff = policy.MinBackoff
+			if backoff == 0 {
+				backoff = DefaultMinRestartBackoff
+			}
+		} else {
+			backoff *= 2
+		}
+		max := policy.MaxBackoff
+		if max == 0 {
+			max = DefaultMaxRestartBackoff
+		}
+		if backoff > max {
+			backoff = max
+		}
+		log.Printf("stacked: ListenServer for %v failed: %v; restarting in %v", ln.Addr(), err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ln.done:
+			return
+		}
+	}
+}
+
+// fail gives up on the ListenServer, closing all of its listeners.
+func (cbs *connBufShim) fail(err error) {
+	cbs.mu.Lock()
+	if cbs.err == nil {
+		cbs.err = err
+	}
+	for _, ln := range cbs.listeners {
+		ln.stop()
+	}
+	cbs.mu.Unlock()
+	cbs.deadOnce.Do(func() { close(cbs.deadChan()) })
+}
+
+// failed returns a channel that's closed once a Critical ListenServer is
+// given up on, after which failure returns why.
+func (cbs *connBufShim) failed() <-chan struct{} {
+	if !cbs.Critical {
+		return nil
+	}
+	return cbs.deadChan()
+}
+
+func (cbs *connBufShim) failure() error {
+	cbs.mu.Lock()
+	defer cbs.mu.Unlock()
+	return cbs.err
+}
+
+func (cbs *connBufShim) deadChan() chan struct{} {
+	cbs.mu.Lock()
+	defer cbs.mu.Unlock()
+	if cbs.dead == nil {
+		cbs.dead = make(chan struct{})
+	}
+	return cbs.dead
+}
+
+// Stop closes any bufListeners, and then shuts down the ListenServer if it
+// has a Shutdown method like http.Server's.
+func (cbs *connBufShim) Stop(ctx context.Context) error {
+	err := cbs.Close()
+	if s, ok := cbs.Server.(interface {
+		Shutdown(ctx context.Context) error
+	}); ok {
+		err = errors.Join(err, s.Shutdown(ctx))
+	}
+	return err
 }
 
 // Close closes any bufListeners
 func (cbs *connBufShim) Close() error {
-	if cbs.listeners == nil {
-		for _, ln := range cbs.listeners {
-			ln.Close() // TODO: care about error? use a MultiError?
-		}
-		cbs.listeners = nil
+	cbs.mu.Lock()
+	defer cbs.mu.Unlock()
+	cbs.closed = true
+	for _, ln := range cbs.listeners {
+		ln.stop()
 	}
+	cbs.listeners = nil
 	return nil
 }
@@ -0,0 +1,214 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+// stuckServer accepts once per Serve call, and then never again.
+type stuckServer struct {
+	mu     sync.Mutex
+	serves int
+}
+
+func (ss *stuckServer) Serve(ln net.Listener) error {
+	ss.mu.Lock()
+	ss.serves++
+	ss.mu.Unlock()
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	select {}
+}
+
+func (ss *stuckServer) serveCount() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.serves
+}
+
+// handoff serves a new pipe connection, returning the client side once the
+// handler is done with it.
+func handoff(srv *stacked.Server) net.Conn {
+	client, server := net.Pipe()
+	srv.ServeConn(server)
+	return client
+}
+
+func isClosed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF || err == io.ErrClosedPipe
+}
+
+func TestListenServerQueue(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		depths []int
+	)
+	ls := &stuckServer{}
+	hndl := stacked.ListenServerHandlerOptions(ls, stacked.ListenServerOptions{
+		QueueSize:      1,
+		EnqueueTimeout: 20 * time.Millisecond,
+		OnQueueDepth: func(_ net.Addr, depth int) {
+			mu.Lock()
+			depths = append(depths, depth)
+			mu.Unlock()
+		},
+	})
+	srv := stacked.NewServer(stacked.FallthroughDetector(hndl))
+
+	// the first is accepted, the second waits in the queue, and the third
+	// overflows
+	accepted := handoff(srv)
+	for ls.serveCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued := handoff(srv)
+	rejected := handoff(srv)
+	if isClosed(queued) || !isClosed(rejected) {
+		t.Fatal("expected only the overflowing connection to be closed")
+	}
+
+	hndl.(io.Closer).Close()
+	if !isClosed(queued) {
+		t.Fatal("expected queued connection to be closed along with the handler")
+	}
+	if isClosed(accepted) {
+		t.Fatal("expected accepted connection to be left to its server")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(depths) == 0 || depths[len(depths)-1] != 0 {
+		t.Fatalf("unexpected queue depths %v", depths)
+	}
+}
+
+func TestListenServerOverflowClose(t *testing.T) {
+	ls := &stuckServer{}
+	srv := stacked.NewServer(stacked.FallthroughDetector(
+		stacked.ListenServerHandlerOptions(ls, stacked.ListenServerOptions{
+			EnqueueTimeout: 20 * time.Millisecond,
+			Overflow:       stacked.OverflowClose,
+		})))
+
+	handoff(srv)
+	if rejected := handoff(srv); !isClosed(rejected) {
+		t.Fatal("expected overflowing connection to be closed")
+	}
+	if accepted := handoff(srv); isClosed(accepted) {
+		t.Fatal("expected a fresh listener to accept the next connection")
+	}
+	if n := ls.serveCount(); n != 2 {
+		t.Fatalf("expected Serve to be called twice, got %v", n)
+	}
+}
+
+// flakyServer accepts a single connection per Serve call, closes it, and
+// then fails, closing the listener first if closes is set, as http.Server
+// does.
+type flakyServer struct {
+	closes bool
+}
+
+var errFlaky = errors.New("flaky server failed")
+
+func (fs flakyServer) Serve(ln net.Listener) error {
+	if fs.closes {
+		defer ln.Close()
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return errFlaky
+}
+
+func TestListenServerRestart(t *testing.T) {
+	for _, fs := range []flakyServer{{}, {closes: true}} {
+		errs := make(chan error, 10)
+		srv := stacked.NewServer(stacked.FallthroughDetector(
+			stacked.ListenServerHandlerOptions(fs, stacked.ListenServerOptions{
+				EnqueueTimeout: time.Second,
+				OnServeError:   func(_ net.Addr, err error) { errs <- err },
+			})))
+
+		for i := 0; i < 3; i++ {
+			if conn := handoff(srv); !isClosed(conn) {
+				t.Fatalf("%+v: connection %v: expected to be served and closed", fs, i)
+			}
+			select {
+			case err := <-errs:
+				if err != errFlaky {
+					t.Fatalf("%+v: unexpected Serve error %v", fs, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%+v: Serve error wasn't reported", fs)
+			}
+		}
+	}
+}
+
+func TestListenServerCritical(t *testing.T) {
+	for _, fs := range []flakyServer{{}, {closes: true}} {
+		testListenServerCritical(t, fs)
+	}
+}
+
+func testListenServerCritical(t *testing.T, fs flakyServer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- stacked.NewServer(stacked.FallthroughDetector(
+			stacked.ListenServerHandlerOptions(fs, stacked.ListenServerOptions{
+				Critical: true,
+			}))).Serve(ln)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-served:
+		if err != errFlaky {
+			t.Fatalf("%+v: expected Serve to fail with the critical error, got %v", fs, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%+v: expected Serve to fail fast", fs)
+	}
+}
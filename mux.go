@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+)
+
+// yamux frame header is version:1 type:1 flags:2 stream:4 length:4
+const yamuxHeaderSize = 12
+
+const (
+	yamuxTypeData         = 0x0
+	yamuxTypeWindowUpdate = 0x1
+	yamuxTypePing         = 0x2
+	yamuxFlagSYN          = 0x1
+)
+
+// isYamuxOpen checks whether b is a yamux frame header that a client would
+// start a session with: opening a stream, or a ping.
+func isYamuxOpen(b []byte) bool {
+	if b[0] != 0 { // version
+		return false
+	}
+	switch b[1] {
+	case yamuxTypeData, yamuxTypeWindowUpdate, yamuxTypePing:
+	default:
+		return false
+	}
+	flags := binary.BigEndian.Uint16(b[2:4])
+	return flags&yamuxFlagSYN != 0
+}
+
+// MuxDetector returns a Detector for yamux multiplexed sessions.  Each stream
+// that the client opens over the session is served by srv, as if it were a
+// new connection; so one client connection can carry, say, HTTP, tchannel and
+// raw line protocol streams side by side.  If config is nil,
+// yamux.DefaultConfig is used.
+func MuxDetector(srv *Server, config *yamux.Config) Detector {
+	if config == nil {
+		config = yamux.DefaultConfig()
+	}
+	return Detector{
+		Needed:  yamuxHeaderSize,
+		Test:    isYamuxOpen,
+		Handler: &muxShim{srv: srv, config: config},
+	}
+}
+
+// muxShim implements Handler by running a yamux server session over each
+// connection, and serving its streams with a nested Server.
+type muxShim struct {
+	srv      *Server
+	config   *yamux.Config
+	mu       sync.Mutex
+	sessions map[*yamux.Session]struct{}
+}
+
+func (ms *muxShim) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	sess, err := yamux.Server(&bufConn{conn, bufr}, ms.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	ms.mu.Lock()
+	if ms.sessions == nil {
+		ms.sessions = make(map[*yamux.Session]struct{})
+	}
+	ms.sessions[sess] = struct{}{}
+	ms.mu.Unlock()
+
+	defer func() {
+		ms.mu.Lock()
+		delete(ms.sessions, sess)
+		ms.mu.Unlock()
+		sess.Close()
+	}()
+
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		go ms.srv.ServeConn(stream)
+	}
+}
+
+// Start starts the nested Server's handlers.
+func (ms *muxShim) Start(ctx context.Context) error {
+	return ms.srv.start(ctx)
+}
+
+// Stop shuts down the nested Server, and then closes any open sessions.
+func (ms *muxShim) Stop(ctx context.Context) error {
+	err := ms.srv.Shutdown(ctx)
+	return errors.Join(err, ms.closeSessions())
+}
+
+// Close closes any open sessions, and the nested Server's handlers.
+func (ms *muxShim) Close() error {
+	err := ms.closeSessions()
+	return errors.Join(err, ms.srv.closeDetectors())
+}
+
+func (ms *muxShim) closeSessions() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var err error
+	for sess := range ms.sessions {
+		err = errors.Join(err, sess.Close())
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestMuxDetector(t *testing.T) {
+	inner := stacked.NewServer(
+		stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)),
+		stacked.DefaultHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "over yamux")
+		})),
+	)
+	ln := serveTest(t,
+		stacked.MuxDetector(inner, nil),
+		stacked.FallthroughDetector(stacked.HandlerFunc(lineEcho)),
+	)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := yamux.Client(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	echo, err := sess.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	io.WriteString(echo, "echo one\n")
+
+	// open an HTTP stream while the echo stream is still going
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) { return sess.Open() },
+	}}
+	resp, err := client.Get("http://yamux/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "over yamux" {
+		t.Fatalf("unexpected HTTP response %q", body)
+	}
+
+	bufr := bufio.NewReader(echo)
+	io.WriteString(echo, "echo two\n")
+	for _, want := range []string{"> echo one\n", "> echo two\n"} {
+		if got, err := bufr.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
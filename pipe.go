@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies data in both directions between a and b until both reach EOF,
+// and then closes them.  When one direction is done, its destination is
+// half-closed if possible so that the peer sees EOF; otherwise both
+// connections are closed right away.  It returns how many bytes were copied
+// from a to b and from b to a, along with the first error encountered.
+func pipe(a, b net.Conn) (aToB, bToA int64, err error) {
+	type result struct {
+		n   int64
+		err error
+	}
+	copyHalf := func(dst, src net.Conn, done chan<- result) {
+		n, err := io.Copy(dst, src)
+		if errors.Is(err, net.ErrClosed) {
+			// we closed it ourselves, after the other direction ended
+			err = nil
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			if cerr := cw.CloseWrite(); cerr != nil {
+				dst.Close()
+				src.Close()
+			}
+		} else {
+			dst.Close()
+			src.Close()
+		}
+		done <- result{n, err}
+	}
+
+	aDone := make(chan result, 1)
+	bDone := make(chan result, 1)
+	go copyHalf(b, a, aDone)
+	go copyHalf(a, b, bDone)
+	ra, rb := <-aDone, <-bDone
+	a.Close()
+	b.Close()
+
+	err = ra.err
+	if err == nil {
+		err = rb.err
+	}
+	return ra.n, rb.n, err
+}
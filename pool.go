@@ -0,0 +1,303 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults used by a Pool for any zero-valued settings.
+const (
+	DefaultHealthCheckTimeout = time.Second
+	DefaultPoolMaxFails       = 3
+	DefaultPoolEjectDuration  = 30 * time.Second
+)
+
+// number of points each backend gets on the consistent hash ring
+const poolRingReplicas = 64
+
+var errNoUpstream = errors.New("no upstream available")
+
+// Balancer chooses how a Pool spreads connections over its backends.
+type Balancer int
+
+const (
+	// RoundRobin takes turns over the available backends.
+	RoundRobin Balancer = iota
+
+	// LeastConnections picks the available backend with the fewest
+	// connections currently being proxied.
+	LeastConnections
+
+	// ClientIPHash consistently maps each client IP to the same backend,
+	// only moving the clients of a backend when it becomes unavailable.
+	ClientIPHash
+)
+
+// Pool is a set of upstream addresses for a Proxy to balance over.
+//
+// Backends failing an active health check, dialing them as the Proxy does,
+// are ejected until they pass one again, while backends that fail MaxFails
+// consecutive dials are ejected for EjectDuration.  Health checks start along
+// with the first connection, and stop only when the Pool is closed, which is
+// left to its owner rather than to any Proxy.  A Pool shared by several
+// Proxies is health checked by the first one to use it.
+type Pool struct {
+	// Balancer is the balancing strategy, RoundRobin by default.
+	Balancer Balancer
+
+	// HealthCheckInterval is how often to dial each backend, checking that
+	// it's accepting connections; zero disables active health checks.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout bounds each health check dial;
+	// DefaultHealthCheckTimeout is used if zero.
+	HealthCheckTimeout time.Duration
+
+	// MaxFails is how many consecutive failed dials eject a backend;
+	// DefaultPoolMaxFails is used if zero.
+	MaxFails int
+
+	// EjectDuration is how long a backend is ejected after MaxFails;
+	// DefaultPoolEjectDuration is used if zero.
+	EjectDuration time.Duration
+
+	mu       sync.Mutex
+	backends []*poolBackend
+	ring     []poolRingPoint
+	next     int
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type poolBackend struct {
+	addr         string
+	active       int
+	fails        int
+	unhealthy    bool
+	ejectedUntil time.Time
+}
+
+type poolRingPoint struct {
+	hash    uint32
+	backend *poolBackend
+}
+
+// NewPool creates a Pool over the given upstream addresses.
+func NewPool(addrs ...string) *Pool {
+	pool := &Pool{done: make(chan struct{})}
+	for _, addr := range addrs {
+		be := &poolBackend{addr: addr}
+		pool.backends = append(pool.backends, be)
+		for i := 0; i < poolRingReplicas; i++ {
+			pool.ring = append(pool.ring, poolRingPoint{hashString(addr + "#" + strconv.Itoa(i)), be})
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+	return pool
+}
+
+// PoolHandler returns a Proxy that balances over pool.
+func PoolHandler(pool *Pool) *Proxy {
+	return &Proxy{Pool: pool}
+}
+
+// Available returns the addresses of backends that aren't currently ejected.
+func (pool *Pool) Available() []string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	now := time.Now()
+	var addrs []string
+	for _, be := range pool.backends {
+		if be.available(now) {
+			addrs = append(addrs, be.addr)
+		}
+	}
+	return addrs
+}
+
+// Close stops health checking, bringing back backends it had ejected.
+func (pool *Pool) Close() error {
+	pool.closeOnce.Do(func() { close(pool.done) })
+	return nil
+}
+
+func (be *poolBackend) available(now time.Time) bool {
+	return !be.unhealthy && !now.Before(be.ejectedUntil)
+}
+
+// acquire picks an available backend for a connection from client, skipping
+// any in tried, and counts it as active.
+func (pool *Pool) acquire(client net.Addr, tried map[*poolBackend]bool) (*poolBackend, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := time.Now()
+	usable := func(be *poolBackend) bool {
+		return !tried[be] && be.available(now)
+	}
+
+	var be *poolBackend
+	switch pool.Balancer {
+	case LeastConnections:
+		n := len(pool.backends)
+		for i := 0; i < n; i++ {
+			cand := pool.backends[(pool.next+i)%n]
+			if usable(cand) && (be == nil || cand.active < be.active) {
+				be = cand
+			}
+		}
+		pool.next++
+
+	case ClientIPHash:
+		h := hashString(clientIP(client))
+		i := sort.Search(len(pool.ring), func(i int) bool { return pool.ring[i].hash >= h })
+		for j := 0; j < len(pool.ring); j++ {
+			if cand := pool.ring[(i+j)%len(pool.ring)].backend; usable(cand) {
+				be = cand
+				break
+			}
+		}
+
+	default:
+		n := len(pool.backends)
+		for i := 0; i < n; i++ {
+			cand := pool.backends[(pool.next+i)%n]
+			if usable(cand) {
+				be = cand
+				pool.next += i + 1
+				break
+			}
+		}
+	}
+
+	if be == nil {
+		return nil, errNoUpstream
+	}
+	be.active++
+	return be, nil
+}
+
+// release marks a connection to be as finished.
+func (pool *Pool) release(be *poolBackend) {
+	pool.mu.Lock()
+	be.active--
+	pool.mu.Unlock()
+}
+
+// dialed records the outcome of dialing be, ejecting it after too many
+// consecutive failures.
+func (pool *Pool) dialed(be *poolBackend, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if err == nil {
+		be.fails = 0
+		return
+	}
+	be.fails++
+	maxFails := pool.MaxFails
+	if maxFails == 0 {
+		maxFails = DefaultPoolMaxFails
+	}
+	if be.fails >= maxFails {
+		eject := pool.EjectDuration
+		if eject == 0 {
+			eject = DefaultPoolEjectDuration
+		}
+		be.ejectedUntil = time.Now().Add(eject)
+		be.fails = 0
+	}
+}
+
+// start starts health checks, once, dialing backends with dial.
+func (pool *Pool) start(dial func(addr string, timeout time.Duration) (net.Conn, error)) {
+	pool.startOnce.Do(func() {
+		if pool.HealthCheckInterval > 0 {
+			go pool.healthChecks(dial)
+		}
+	})
+}
+
+func (pool *Pool) healthChecks(dial func(addr string, timeout time.Duration) (net.Conn, error)) {
+	ticker := time.NewTicker(pool.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		pool.checkHealth(dial)
+		select {
+		case <-ticker.C:
+		case <-pool.done:
+			pool.mu.Lock()
+			for _, be := range pool.backends {
+				be.unhealthy = false
+			}
+			pool.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (pool *Pool) checkHealth(dial func(addr string, timeout time.Duration) (net.Conn, error)) {
+	timeout := pool.HealthCheckTimeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+
+	var wg sync.WaitGroup
+	for _, be := range pool.backends {
+		wg.Add(1)
+		go func(be *poolBackend) {
+			defer wg.Done()
+			conn, err := dial(be.addr, timeout)
+			if err == nil {
+				conn.Close()
+			}
+			pool.mu.Lock()
+			be.unhealthy = err != nil
+			pool.mu.Unlock()
+		}(be)
+	}
+	wg.Wait()
+}
+
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+// identServers starts n servers that each greet connections with their
+// address.
+func identServers(t *testing.T, n int) []net.Listener {
+	lns := make([]net.Listener, n)
+	for i := range lns {
+		lns[i] = serveTest(t, stacked.FallthroughDetector(stacked.HandlerFunc(
+			func(conn net.Conn, bufr *bufio.Reader) {
+				io.WriteString(conn, conn.LocalAddr().String()+"\n")
+				io.Copy(io.Discard, bufr)
+				conn.Close()
+			})))
+	}
+	return lns
+}
+
+func poolAddrs(lns []net.Listener) []string {
+	addrs := make([]string, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr().String()
+	}
+	return addrs
+}
+
+func whoAnswers(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hi\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line[:len(line)-1]
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	backends := identServers(t, 3)
+	addrs := poolAddrs(backends)
+	pool := stacked.NewPool(addrs...)
+	pool.MaxFails = 1
+	ln := serveTest(t, stacked.FallthroughDetector(stacked.PoolHandler(pool)))
+	defer ln.Close()
+
+	for i := 0; i < 6; i++ {
+		if got := whoAnswers(t, ln.Addr().String()); got != addrs[i%3] {
+			t.Fatalf("connection %v: expected %v, got %v", i, addrs[i%3], got)
+		}
+	}
+
+	// a dead backend gets ejected, and its connection retried elsewhere
+	backends[0].Close()
+	for i := 0; i < 3; i++ {
+		if got := whoAnswers(t, ln.Addr().String()); got == addrs[0] {
+			t.Fatalf("connection %v: got closed backend", i)
+		}
+	}
+	if got := pool.Available(); len(got) != 2 || got[0] != addrs[1] || got[1] != addrs[2] {
+		t.Fatalf("unexpected available backends %v", got)
+	}
+}
+
+func TestPoolClientIPHash(t *testing.T) {
+	pool := stacked.NewPool(poolAddrs(identServers(t, 3))...)
+	pool.Balancer = stacked.ClientIPHash
+	ln := serveTest(t, stacked.FallthroughDetector(stacked.PoolHandler(pool)))
+	defer ln.Close()
+
+	first := whoAnswers(t, ln.Addr().String())
+	for i := 0; i < 5; i++ {
+		if got := whoAnswers(t, ln.Addr().String()); got != first {
+			t.Fatalf("connection %v: expected %v, got %v", i, first, got)
+		}
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	backends := identServers(t, 2)
+	addrs := poolAddrs(backends)
+	pool := stacked.NewPool(addrs...)
+	pool.HealthCheckInterval = 10 * time.Millisecond
+	ln := serveTest(t, stacked.FallthroughDetector(stacked.PoolHandler(pool)))
+	defer ln.Close()
+	defer pool.Close()
+
+	whoAnswers(t, ln.Addr().String()) // starts health checking
+	backends[1].Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if got := pool.Available(); len(got) == 1 && got[0] == addrs[0] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("closed backend never ejected, available: %v", pool.Available())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolSharedHealthCheck(t *testing.T) {
+	backends := identServers(t, 2)
+	addrs := poolAddrs(backends)
+	pool := stacked.NewPool(addrs...)
+	pool.HealthCheckInterval = 10 * time.Millisecond
+	defer pool.Close()
+	first := stacked.NewServer(stacked.FallthroughDetector(stacked.PoolHandler(pool)))
+	firstLn := serveTestServer(t, first)
+	second := serveTest(t, stacked.FallthroughDetector(stacked.PoolHandler(pool)))
+	defer second.Close()
+
+	whoAnswers(t, firstLn.Addr().String()) // starts health checking
+	whoAnswers(t, second.Addr().String())
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Pool outlives the first Proxy, so the second still sees ejections
+	backends[1].Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if got := pool.Available(); len(got) == 1 && got[0] == addrs[0] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("closed backend never ejected, available: %v", pool.Available())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := whoAnswers(t, second.Addr().String()); got != addrs[0] {
+		t.Fatalf("expected %v to answer, got %v", addrs[0], got)
+	}
+}
+
+func TestPoolHealthCheckNetwork(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(t.TempDir(), "backend.sock")
+		backend, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		go stacked.NewServer(stacked.FallthroughDetector(stacked.HandlerFunc(
+			func(conn net.Conn, bufr *bufio.Reader) {
+				io.WriteString(conn, "unix\n")
+				conn.Close()
+			}))).Serve(backend)
+		addrs = append(addrs, path)
+	}
+	pool := stacked.NewPool(addrs...)
+	pool.HealthCheckInterval = 10 * time.Millisecond
+	defer pool.Close()
+	proxy := stacked.PoolHandler(pool)
+	proxy.Network = "unix"
+	ln := serveTest(t, stacked.FallthroughDetector(proxy))
+	defer ln.Close()
+
+	// health checks dial as the Proxy does, so the backends stay available
+	whoAnswers(t, ln.Addr().String())
+	time.Sleep(50 * time.Millisecond)
+	if got := pool.Available(); len(got) != 2 {
+		t.Fatalf("expected both backends available, got %v", got)
+	}
+	if got := whoAnswers(t, ln.Addr().String()); got != "unix" {
+		t.Fatalf("unexpected answer %q", got)
+	}
+}
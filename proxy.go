@@ -0,0 +1,188 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProxyDialTimeout is used when a Proxy has no DialTimeout.
+const DefaultProxyDialTimeout = 10 * time.Second
+
+// Proxy implements Handler by forwarding connections to an upstream address
+// in another process; bytes buffered during detection are sent first, and then
+// data is piped in both directions, passing half-closes through.
+type Proxy struct {
+	// Upstream is the address to forward connections to.
+	Upstream string
+
+	// Pool, if non-nil, is balanced over instead of dialing Upstream.
+	Pool *Pool
+
+	// Network is the upstream network, "tcp" if empty.
+	Network string
+
+	// DialTimeout bounds how long connecting to Upstream may take;
+	// DefaultProxyDialTimeout is used if zero.
+	DialTimeout time.Duration
+
+	// Dial, if non-nil, is used to connect instead of a net.Dialer with
+	// DialTimeout, including for Pool health checks, so it should bound
+	// how long it takes itself.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// OnError, if non-nil, is called with any error that ends a proxied
+	// connection, e.g. failing to dial Upstream.
+	OnError func(conn net.Conn, err error)
+
+	// OnClose, if non-nil, is called after each proxied connection is
+	// closed, with how many bytes were sent to and received from upstream.
+	OnClose func(conn net.Conn, sent, received int64)
+
+	sent, received int64
+}
+
+// ProxyHandler returns a Proxy to upstream with default settings.
+func ProxyHandler(upstream string) *Proxy {
+	return &Proxy{Upstream: upstream}
+}
+
+// BytesSent returns the total number of bytes sent upstream.
+func (p *Proxy) BytesSent() int64 {
+	return atomic.LoadInt64(&p.sent)
+}
+
+// BytesReceived returns the total number of bytes received from upstream.
+func (p *Proxy) BytesReceived() int64 {
+	return atomic.LoadInt64(&p.received)
+}
+
+// ServeConnection dials upstream and pipes conn to it.
+func (p *Proxy) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	if p.Pool != nil {
+		p.servePool(conn, bufr)
+		return
+	}
+	upstream, err := p.dial(p.Upstream)
+	if err != nil {
+		conn.Close()
+		p.error(conn, err)
+		return
+	}
+	p.forward(conn, bufr, upstream)
+}
+
+// servePool forwards conn to a backend chosen from the Pool, moving on to
+// another backend if dialing fails.
+func (p *Proxy) servePool(conn net.Conn, bufr *bufio.Reader) {
+	p.Pool.start(p.dialTimeout)
+	tried := make(map[*poolBackend]bool)
+	for {
+		be, err := p.Pool.acquire(conn.RemoteAddr(), tried)
+		if err != nil {
+			conn.Close()
+			p.error(conn, err)
+			return
+		}
+		tried[be] = true
+
+		upstream, err := p.dial(be.addr)
+		p.Pool.dialed(be, err)
+		if err != nil {
+			p.Pool.release(be)
+			p.error(conn, err)
+			continue
+		}
+		p.forward(conn, bufr, upstream)
+		p.Pool.release(be)
+		return
+	}
+}
+
+// Start starts the Pool's health checks, if any, rather than waiting for the
+// first connection.  The Pool outlives the Proxy, so its owner closes it.
+func (p *Proxy) Start(ctx context.Context) error {
+	if p.Pool != nil {
+		p.Pool.start(p.dialTimeout)
+	}
+	return nil
+}
+
+func (p *Proxy) dial(addr string) (net.Conn, error) {
+	timeout := p.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultProxyDialTimeout
+	}
+	return p.dialTimeout(addr, timeout)
+}
+
+// dialTimeout dials addr on Network, bounded by timeout unless Dial is set.
+func (p *Proxy) dialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	network := p.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if p.Dial != nil {
+		return p.Dial(network, addr)
+	}
+	return net.DialTimeout(network, addr, timeout)
+}
+
+// forward writes anything already buffered to upstream, and then pipes the
+// raw connections together.
+func (p *Proxy) forward(conn net.Conn, bufr *bufio.Reader, upstream net.Conn) {
+	var sent, received int64
+	if n := bufr.Buffered(); n > 0 {
+		b, _ := bufr.Peek(n)
+		m, err := upstream.Write(b)
+		sent += int64(m)
+		if err != nil {
+			conn.Close()
+			upstream.Close()
+			p.done(conn, sent, received, err)
+			return
+		}
+		bufr.Discard(m)
+	}
+	n, m, err := pipe(conn, upstream)
+	p.done(conn, sent+n, received+m, err)
+}
+
+func (p *Proxy) done(conn net.Conn, sent, received int64, err error) {
+	atomic.AddInt64(&p.sent, sent)
+	atomic.AddInt64(&p.received, received)
+	if err != nil {
+		p.error(conn, err)
+	}
+	if p.OnClose != nil {
+		p.OnClose(conn, sent, received)
+	}
+}
+
+func (p *Proxy) error(conn net.Conn, err error) {
+	if p.OnError != nil {
+		p.OnError(conn, err)
+	}
+}
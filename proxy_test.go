@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestProxyHandler(t *testing.T) {
+	echoLn, _ := echoServer(t)
+	defer echoLn.Close()
+
+	var (
+		mu     sync.Mutex
+		closed = make(chan struct{})
+		stats  [2]int64
+	)
+	proxy := stacked.ProxyHandler(echoLn.Addr().String())
+	proxy.OnClose = func(_ net.Conn, sent, received int64) {
+		mu.Lock()
+		stats = [2]int64{sent, received}
+		mu.Unlock()
+		close(closed)
+	}
+	ln := serveTest(t, stacked.PrefixDetector("echo", proxy))
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the detected prefix must be forwarded along with the rest
+	io.WriteString(conn, "echo one\necho two\n")
+	conn.(*net.TCPConn).CloseWrite()
+
+	b, err := io.ReadAll(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "> echo one\n> echo two\n" {
+		t.Fatalf("unexpected response %q", b)
+	}
+
+	<-closed
+	mu.Lock()
+	defer mu.Unlock()
+	if stats != [2]int64{18, 22} {
+		t.Fatalf("unexpected connection byte counts %v", stats)
+	}
+	if proxy.BytesSent() != 18 || proxy.BytesReceived() != 22 {
+		t.Fatalf("unexpected total byte counts %v, %v", proxy.BytesSent(), proxy.BytesReceived())
+	}
+}
+
+func TestProxyHandlerDialError(t *testing.T) {
+	deadLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLn.Close()
+
+	errs := make(chan error, 1)
+	proxy := stacked.ProxyHandler(deadLn.Addr().String())
+	proxy.OnError = func(_ net.Conn, err error) { errs <- err }
+	ln := serveTest(t, stacked.FallthroughDetector(proxy))
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "hello\n")
+
+	if err := <-errs; err == nil {
+		t.Fatal("expected a dial error")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RateLimit is a token bucket rate limit: Rate connections per second, in
+// bursts of up to Burst.  A zero Rate means no limit.
+type RateLimit struct {
+	Rate float64
+
+	// Burst defaults to Rate rounded up, and at least 1.
+	Burst int
+}
+
+func (rl RateLimit) burst() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+	return math.Max(1, math.Ceil(rl.Rate))
+}
+
+// rateKey is what a rate limit bucket is kept for: a client IP prefix, and
+// a Detector's state, or nil.
+type rateKey struct {
+	prefix string
+	det    *detectorState
+}
+
+type rateBucket struct {
+	key    rateKey
+	tokens float64
+	last   time.Time
+}
+
+// rateBuckets is a bounded table of rate limit buckets, evicting the least
+// recently used ones.
+type rateBuckets struct {
+	lru     list.List // of *rateBucket, most recently used first
+	buckets map[rateKey]*list.Element
+}
+
+// take takes a token from key's bucket, unless it's empty, first evicting
+// buckets to keep at most max.
+func (rb *rateBuckets) take(key rateKey, limit RateLimit, max int, now time.Time) bool {
+	burst := limit.burst()
+	el := rb.buckets[key]
+	if el == nil {
+		for rb.lru.Len() >= max {
+			old := rb.lru.Remove(rb.lru.Back()).(*rateBucket)
+			delete(rb.buckets, old.key)
+		}
+		if rb.buckets == nil {
+			rb.buckets = make(map[rateKey]*list.Element)
+		}
+		el = rb.lru.PushFront(&rateBucket{key: key, tokens: burst, last: now})
+		rb.buckets[key] = el
+	} else {
+		rb.lru.MoveToFront(el)
+	}
+
+	b := el.Value.(*rateBucket)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ipPrefix masks a client IP to the given number of bits, if non-zero,
+// returning it in CIDR notation.
+func ipPrefix(host string, v4bits, v6bits int) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if v4bits <= 0 || v4bits >= 32 {
+			return ip4.String()
+		}
+		return ip4.Mask(net.CIDRMask(v4bits, 32)).String() + "/" + strconv.Itoa(v4bits)
+	}
+	if v6bits <= 0 || v6bits >= 128 {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(v6bits, 128)).String() + "/" + strconv.Itoa(v6bits)
+}
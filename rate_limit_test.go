@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateBuckets(t *testing.T) {
+	var rb rateBuckets
+	limit := RateLimit{Rate: 2, Burst: 2}
+	now := time.Now()
+	a, b, c := rateKey{"a", nil}, rateKey{"b", nil}, rateKey{"c", nil}
+
+	for i, want := range []bool{true, true, false} {
+		if got := rb.take(a, limit, 2, now); got != want {
+			t.Fatalf("take %d: expected %v", i, want)
+		}
+	}
+	if !rb.take(a, limit, 2, now.Add(500*time.Millisecond)) {
+		t.Fatal("expected a token after refilling")
+	}
+
+	// b and c evict a, which starts afresh
+	rb.take(b, limit, 2, now)
+	rb.take(c, limit, 2, now)
+	if len(rb.buckets) != 2 || rb.buckets[a] != nil {
+		t.Fatalf("expected a to be evicted, have %d buckets", len(rb.buckets))
+	}
+	if !rb.take(a, limit, 2, now.Add(500*time.Millisecond)) {
+		t.Fatal("expected a full bucket after eviction")
+	}
+}
+
+func TestIPPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		host           string
+		v4bits, v6bits int
+		want           string
+	}{
+		{"10.1.2.3", 0, 0, "10.1.2.3"},
+		{"10.1.2.3", 24, 0, "10.1.2.0/24"},
+		{"2001:db8::1", 24, 0, "2001:db8::1"},
+		{"2001:db8:1:2::1", 24, 48, "2001:db8:1::/48"},
+		{"/tmp/sock", 24, 48, "/tmp/sock"},
+	} {
+		if got := ipPrefix(tt.host, tt.v4bits, tt.v6bits); got != tt.want {
+			t.Errorf("ipPrefix(%q, %d, %d) = %q, expected %q", tt.host, tt.v4bits, tt.v6bits, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RestartOptions configures Server.Restart; the zero value re-executes the
+// running binary with the same arguments and environment.
+type RestartOptions struct {
+	// Path is the binary to run, instead of os.Executable.
+	Path string
+
+	// Args are its arguments, instead of os.Args[1:].
+	Args []string
+
+	// Env is its environment, instead of os.Environ; any LISTEN_* and
+	// STACKED_RESTART variables are replaced.
+	Env []string
+
+	// DrainTimeout bounds how long RestartOnSignal waits for connections
+	// to drain; zero means waiting as long as that takes.
+	DrainTimeout time.Duration
+
+	// OnRestart, if non-nil, is called by RestartOnSignal with the new
+	// process, if it was started, and any error from restarting; otherwise
+	// the outcome is logged.
+	OnRestart func(proc *os.Process, err error)
+}
+
+// Restart hands the Server's listeners to a new process, and then shuts down
+// gracefully, as by Shutdown(ctx).  The new process should serve the same
+// addresses with ListenAndServe, which picks the listeners up through socket
+// activation's LISTEN_FDS instead of opening new ones, so no connection is
+// refused while it starts; STACKED_RESTART=1 marks them as handed over by
+// Restart, since ListenAndServe otherwise leaves activated sockets alone.
+// Listeners passed by socket activation keep their names, so a new process
+// may pick them up with ServeActivated or systemd:NAME addresses instead.
+// If the new process can't be started, the Server keeps serving.
+//
+// As with http.Server.Shutdown, Serve returns as soon as the listeners are
+// closed, so the program shouldn't exit until Restart returns.
+func (srv *Server) Restart(ctx context.Context, opts RestartOptions) (*os.Process, error) {
+	proc, err := srv.startSuccessor(opts)
+	if err != nil {
+		return nil, err
+	}
+	return proc, srv.Shutdown(ctx)
+}
+
+// RestartOnSignal calls Restart whenever one of sigs (SIGHUP if none are
+// given) arrives, until the returned stop function is called.
+func (srv *Server) RestartOnSignal(opts RestartOptions, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+			ctx, cancel := context.Background(), context.CancelFunc(func() {})
+			if opts.DrainTimeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, opts.DrainTimeout)
+			}
+			proc, err := srv.Restart(ctx, opts)
+			cancel()
+			switch {
+			case opts.OnRestart != nil:
+				opts.OnRestart(proc, err)
+			case proc == nil:
+				log.Printf("stacked: restart failed: %v", err)
+			case err != nil:
+				log.Printf("stacked: restarted as pid %d, but draining failed: %v", proc.Pid, err)
+			default:
+				log.Printf("stacked: restarted as pid %d", proc.Pid)
+			}
+		}
+	}()
+	return stop
+}
+
+// restartName is how a listener opened with ListenAndServe(addr) is named in
+// LISTEN_FDNAMES, which can't contain colons.
+func restartName(addr string) string {
+	return url.QueryEscape(addr)
+}
+
+// handoverName is how a listener served under name is passed on by Restart:
+// by its socket activation name, if it has one, so that ServeActivated and
+// systemd:NAME addresses find it again, or else by restartName.
+func handoverName(ln net.Listener, name string) string {
+	if name, ok := activationName(ln); ok {
+		return name
+	}
+	return restartName(name)
+}
+
+// startSuccessor starts the new process for Restart, passing it the
+// listeners.
+func (srv *Server) startSuccessor(opts RestartOptions) (*os.Process, error) {
+	var (
+		files []*os.File
+		names []string
+		lns   []net.Listener
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return nil, ErrServerClosed
+	}
+	for ln, name := range srv.listeners {
+		filer, ok := (*ln).(interface{ File() (*os.File, error) })
+		if !ok {
+			srv.mu.Unlock()
+			return nil, fmt.Errorf("stacked: can't hand over listener %v of type %T", (*ln).Addr(), *ln)
+		}
+		f, err := filer.File()
+		if err != nil {
+			srv.mu.Unlock()
+			return nil, fmt.Errorf("stacked: can't hand over listener %v: %w", (*ln).Addr(), err)
+		}
+		files = append(files, f)
+		names = append(names, handoverName(*ln, name))
+		lns = append(lns, *ln)
+	}
+	srv.mu.Unlock()
+
+	path := opts.Path
+	if path == "" {
+		var err error
+		if path, err = os.Executable(); err != nil {
+			return nil, err
+		}
+	}
+	args := opts.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+	env := opts.Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	cmd := exec.Command(path, args...)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, restartEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		restartEnv+"=1",
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go cmd.Wait()
+
+	// the new process owns any Unix socket paths now
+	for _, ln := range lns {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
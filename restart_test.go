@@ -0,0 +1,110 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRestart(t *testing.T) {
+	testRestart(t, "restart", nil)
+}
+
+// TestRestartActivated restarts a process serving with ServeActivated, whose
+// successor must find its sockets under their original names.
+func TestRestartActivated(t *testing.T) {
+	testRestart(t, "restart-activated", []string{"LISTEN_FDS=1", "LISTEN_FDNAMES=echo"})
+}
+
+func testRestart(t *testing.T, mode string, env []string) {
+	ln := listenLocal(t)
+	addr := ln.Addr().String()
+	old := startChild(t, mode, env, ln)
+	exited := make(chan struct{})
+	go func() {
+		old.Process.Wait()
+		close(exited)
+	}()
+
+	// a long-lived connection, which the old process should drain
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bufr := bufio.NewReader(conn)
+	echo := func(line string) {
+		io.WriteString(conn, line+"\n")
+		if got, err := bufr.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if got != "> "+line+"\n" {
+			t.Fatalf("unexpected echo %q", got)
+		}
+	}
+	echo("echo before restart")
+	if got, want := roundTrip(t, addr, "pid?"), fmt.Sprintf("%d ", old.Process.Pid); got != want {
+		t.Fatalf("expected %q from the old process, got %q", want, got)
+	}
+
+	if err := old.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	var newPid int
+	for deadline := time.Now().Add(10 * time.Second); newPid == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("new process never answered")
+		}
+		fields := strings.Fields(roundTrip(t, addr, "pid?"))
+		if pid, _ := strconv.Atoi(fields[0]); pid != old.Process.Pid {
+			newPid = pid
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if proc, err := os.FindProcess(newPid); err == nil {
+		defer proc.Kill()
+	}
+
+	echo("echo while draining")
+	select {
+	case <-exited:
+		t.Fatal("old process exited before draining")
+	default:
+	}
+	conn.Close()
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("old process didn't exit once drained")
+	}
+	if got := roundTrip(t, addr, "echo after restart"); got != "> echo after restart" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}
@@ -22,15 +22,50 @@ package stacked
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrServerClosed is returned by Server.Serve after Shutdown or Close.
+var ErrServerClosed = errors.New("stacked: Server closed")
+
+var errNoListeners = errors.New("stacked: no listeners to serve")
+
 // Server serves one or more Detectors.  The first one whose Test function
-// returns true wins.
-type Server []Detector
+// returns true wins.  The Detectors can be replaced while serving, with
+// SetDetectors.
+//
+// Before accepting connections, Serve starts any handlers that implement
+// Starter.  Shutdown stops them gracefully (see Stopper), while Close just
+// closes them (see io.Closer).
+type Server struct {
+	stack   atomic.Pointer[detectorStack]
+	stackMu sync.Mutex // serializes starting and replacing the stack
+	started bool
+
+	mu        sync.Mutex
+	listeners map[*net.Listener]string // by name, see Restart
+	active    sync.WaitGroup           // accept loops and connections being served
+	closed    bool
+	done      chan struct{} // closed once closed is set
+
+	limiter *connLimiter
+	acl     atomic.Pointer[ACL]
+
+	candidates atomic.Pointer[[]*Candidate]
+
+	startOnce sync.Once
+	startErr  error
+}
 
 // ListenAndServe creates a server for the passed detectors, and has it listend
 // and serve.
@@ -39,30 +74,188 @@ func ListenAndServe(hostPort string, detectors ...Detector) error {
 }
 
 // NewServer creates a new Server from a variadic list of Detectors.
-func NewServer(detectors ...Detector) Server {
-	return Server(detectors)
+func NewServer(detectors ...Detector) *Server {
+	srv := &Server{
+		done:    make(chan struct{}),
+		limiter: newConnLimiter(),
+	}
+	srv.limiter.track(detectors)
+	srv.stack.Store(newDetectorStack(detectors))
+	return srv
+}
+
+// ListenAndServe opens a listening socket for each address, and serves them
+// all with ServeAll.  Addresses are TCP host:ports, or:
+//
+//	unix:PATH    a Unix socket
+//	fd:N         an inherited listening socket, e.g. from exec.Cmd.ExtraFiles
+//	systemd:NAME the sockets named NAME passed by systemd socket activation,
+//	             or all of them if NAME is empty; see ActivatedListeners
+//
+// Listeners handed over by Restart are used in place of opening new ones.
+func (srv *Server) ListenAndServe(addrs ...string) error {
+	return srv.ListenAndServeOptions(ListenOptions{}, addrs...)
+}
+
+// ListenAndServeOptions is like ListenAndServe, but with explicit options for
+// any TCP listeners.
+func (srv *Server) ListenAndServeOptions(opts ListenOptions, addrs ...string) error {
+	var (
+		lns   []net.Listener
+		names []string
+	)
+	for _, addr := range addrs {
+		more, err := Listen(addr, opts)
+		if err != nil {
+			closeListeners(lns)
+			return err
+		}
+		for _, ln := range more {
+			lns = append(lns, ln)
+			names = append(names, addr)
+		}
+	}
+	return srv.serveAll(lns, names)
 }
 
-// ListenAndServe opens a listening TCP socket, and calls Serve on it.
-func (srv Server) ListenAndServe(hostPort string) error {
-	ln, err := net.Listen("tcp", hostPort)
+// Listen opens the listeners for an address as ListenAndServeOptions does,
+// for use with ServeAll; there can be several, e.g. with opts.ReusePort.
+func Listen(addr string, opts ListenOptions) ([]net.Listener, error) {
+	if lns := claimRestarted(restartName(addr)); len(lns) > 0 {
+		return lns, nil
+	}
+	scheme, rest, _ := strings.Cut(addr, ":")
+	var (
+		ln  net.Listener
+		err error
+	)
+	switch scheme {
+	case "systemd":
+		return activatedListeners(rest)
+	case "fd":
+		fd, perr := strconv.Atoi(rest)
+		if perr != nil || fd < 0 {
+			return nil, fmt.Errorf("stacked: invalid file descriptor in %q", addr)
+		}
+		ln, err = fdListener(fd, addr)
+	case "unix":
+		ln, err = net.Listen("unix", rest)
+	default:
+		return opts.listenTCP(addr)
+	}
 	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
+
+// Serve runs a handling loop on a listening socket.  If the listener fails,
+// Serve closes the handlers and returns the listener's error, along with any
+// errors from closing them.  After Shutdown or Close, it returns
+// ErrServerClosed.
+func (srv *Server) Serve(ln net.Listener) error {
+	if err := srv.start(context.Background()); err != nil {
+		ln.Close()
+		return err
+	}
+	err := srv.serve(ln, listenerName(ln))
+	if err == ErrServerClosed {
+		return err
+	}
+	return withCloseError(err, srv.closeDetectors())
+}
+
+// ServeAll serves several listeners at once, e.g. a TCP port and a Unix
+// socket, with the same handlers; ListenServer handlers see a separate
+// listener for each one.  If any listener fails, the Server is closed, and
+// ServeAll returns the failures once all listeners are done.  After Shutdown
+// or Close, it returns ErrServerClosed.
+func (srv *Server) ServeAll(lns ...net.Listener) error {
+	return srv.serveAll(lns, nil)
+}
+
+// serveAll is ServeAll, with names for the listeners, defaulting to their
+// listenerName.
+func (srv *Server) serveAll(lns []net.Listener, names []string) error {
+	if len(lns) == 0 {
+		return errNoListeners
+	}
+	if err := srv.start(context.Background()); err != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
 		return err
 	}
-	return srv.Serve(ln)
+
+	errs := make(chan error, len(lns))
+	for i, ln := range lns {
+		name := listenerName(ln)
+		if i < len(names) {
+			name = names[i]
+		}
+		go func() {
+			err := srv.serve(ln, name)
+			if err != ErrServerClosed {
+				srv.closeListeners()
+			}
+			errs <- err
+		}()
+	}
+	var err error
+	for range lns {
+		switch serr := <-errs; {
+		case serr == ErrServerClosed:
+		case err == nil:
+			err = serr
+		default:
+			err = errors.Join(err, serr)
+		}
+	}
+	if err == nil {
+		return ErrServerClosed
+	}
+	return withCloseError(err, srv.closeDetectors())
+}
+
+// listenerName is the address that ListenAndServe would open ln with.
+func listenerName(ln net.Listener) string {
+	addr := ln.Addr()
+	if strings.HasPrefix(addr.Network(), "unix") {
+		return "unix:" + addr.String()
+	}
+	return addr.String()
 }
 
-// Serve runs a handling loop on a listening socket.
-func (srv Server) Serve(ln net.Listener) error {
-	// TODO: afford start-able handlers?  Currently the requirement is that any
-	// such need is met lazily/on-demand as connBufShim does.
-	defer srv.closeDetectors()
+// serve runs the accept loop for Serve and ServeAll.
+func (srv *Server) serve(ln net.Listener, name string) error {
+	if !srv.trackListener(&ln, name) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer srv.untrackListener(&ln)
+	defer srv.active.Done()
+	defer srv.forgetListener(ln)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	failure := srv.watchCritical(ln, stop)
 
 	var tempDelay time.Duration // how long to sleep on accept failure
 
 	for {
+		// at the limits, stop accepting until there's room, but only count
+		// connections once accepted
+		if !srv.limiter.wait(srv.done) {
+			return ErrServerClosed
+		}
 		conn, err := ln.Accept()
 		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if ferr := failure(); ferr != nil {
+				return ferr
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -79,42 +272,340 @@ func (srv Server) Serve(ln net.Listener) error {
 			return err
 		}
 		tempDelay = 0
+		ticket, ok := srv.limiter.admit(srv.done)
+		if !ok {
+			conn.Close()
+			return ErrServerClosed
+		}
+
+		// the accept loop counts as active itself, so connections that it
+		// accepted are still served during Shutdown
+		srv.active.Add(1)
+		go func() {
+			defer srv.active.Done()
+			srv.handleConnection(ln, conn, ticket)
+		}()
+	}
+}
+
+// ServeConn runs detection on an already established connection, e.g. one
+// accepted by another framework or a net.Pipe, and serves it with the
+// winning Handler.  It returns when that Handler's ServeConnection does.
+func (srv *Server) ServeConn(conn net.Conn) {
+	if !srv.trackConn() {
+		conn.Close()
+		return
+	}
+	defer srv.active.Done()
+	ticket, ok := srv.limiter.admit(nil)
+	if !ok {
+		srv.limiter.rejected(conn, nil, ErrTooManyConns)
+		conn.Close()
+		return
+	}
+	srv.handleConnection(nil, conn, ticket)
+}
+
+// ServeStream is like ServeConn for streams that aren't a net.Conn, e.g. an
+// SSH channel; local and remote are reported as its addresses.
+func (srv *Server) ServeStream(rwc io.ReadWriteCloser, local, remote net.Addr) {
+	srv.ServeConn(newStreamConn(rwc, local, remote))
+}
+
+// Shutdown gracefully shuts down the server: it closes all listeners, stops
+// the handlers, and then waits for connections still being detected or
+// served by synchronous handlers (e.g. a HandlerFunc) to finish.  If ctx is
+// done first, Shutdown returns with its error among any others.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.closeListeners()
+	err = errors.Join(err, srv.stopHandlers(ctx))
+
+	idle := make(chan struct{})
+	go func() {
+		srv.active.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = errors.Join(err, ctx.Err())
+	}
+	return err
+}
+
+// Close immediately closes all listeners and handlers, returning any errors
+// from doing so.
+func (srv *Server) Close() error {
+	return errors.Join(srv.closeListeners(), srv.closeDetectors())
+}
+
+func (srv *Server) closeListeners() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.done)
+	}
+	var err error
+	for ln := range srv.listeners {
+		err = errors.Join(err, (*ln).Close())
+	}
+	return err
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// trackListener registers ln under name, counting its accept loop as active,
+// unless the server is closed.
+func (srv *Server) trackListener(ln *net.Listener, name string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[*net.Listener]string)
+	}
+	srv.listeners[ln] = name
+	srv.active.Add(1)
+	return true
+}
+
+func (srv *Server) untrackListener(ln *net.Listener) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.listeners, ln)
+}
+
+// trackConn counts a connection as active, unless the server is closed;
+// otherwise it would race with Shutdown waiting for active connections.
+func (srv *Server) trackConn() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	srv.active.Add(1)
+	return true
+}
+
+// start starts the handlers, once; if any fail, those already started are
+// stopped again, and the aggregate error is returned by every Serve call.
+func (srv *Server) start(ctx context.Context) error {
+	srv.startOnce.Do(func() {
+		srv.stackMu.Lock()
+		defer srv.stackMu.Unlock()
+		srv.startErr = startHandlers(ctx, srv.stack.Load().handlers())
+		srv.started = true
+	})
+	return srv.startErr
+}
+
+func startHandlers(ctx context.Context, handlers []Handler) error {
+	var (
+		started []Stopper
+		err     error
+	)
+	for _, hndl := range handlers {
+		starter, ok := hndl.(Starter)
+		if !ok {
+			continue
+		}
+		if serr := starter.Start(ctx); serr != nil {
+			err = errors.Join(err, serr)
+		} else if stopper, ok := hndl.(Stopper); ok {
+			started = append(started, stopper)
+		}
+	}
+	if err != nil {
+		for _, stopper := range started {
+			err = errors.Join(err, stopper.Stop(ctx))
+		}
+	}
+	return err
+}
+
+// stopHandlers stops every handler that's a Stopper, and closes the others
+// that are io.Closers.
+func (srv *Server) stopHandlers(ctx context.Context) error {
+	return stopHandlers(ctx, srv.stack.Load().handlers())
+}
+
+func stopHandlers(ctx context.Context, handlers []Handler) error {
+	var err error
+	for _, hndl := range handlers {
+		if stopper, ok := hndl.(Stopper); ok {
+			err = errors.Join(err, stopper.Stop(ctx))
+		} else if closer, ok := hndl.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
+		}
+	}
+	return err
+}
+
+// listenerHandler is implemented by handlers that keep state for each
+// listener that the Server accepts connections from, e.g. the virtual
+// listeners of ListenServer shims.
+type listenerHandler interface {
+	// serveListenerConnection is ServeConnection for a connection accepted
+	// from ln.
+	serveListenerConnection(ln net.Listener, conn net.Conn, bufr *bufio.Reader)
+
+	// closeListener drops any state for ln, once the Server is done with it.
+	closeListener(ln net.Listener)
+}
+
+// serveWith passes conn to hndl, as accepted from ln if that's non-nil.
+func serveWith(hndl Handler, ln net.Listener, conn net.Conn, bufr *bufio.Reader) {
+	if lh, ok := hndl.(listenerHandler); ok && ln != nil {
+		lh.serveListenerConnection(ln, conn, bufr)
+	} else {
+		hndl.ServeConnection(conn, bufr)
+	}
+}
+
+func (srv *Server) forgetListener(ln net.Listener) {
+	for _, hndl := range srv.stack.Load().handlers() {
+		if lh, ok := hndl.(listenerHandler); ok {
+			lh.closeListener(ln)
+		}
+	}
+}
+
+// criticalHandler is implemented by handlers that can fail for good, e.g. a
+// Critical ListenServer shim.
+type criticalHandler interface {
+	failed() <-chan struct{}
+	failure() error
+}
+
+// watchCritical closes ln if any critical handler fails before stop is
+// closed, returning a function that reports the failure, if any.
+func (srv *Server) watchCritical(ln net.Listener, stop <-chan struct{}) func() error {
+	var (
+		mu  sync.Mutex
+		err error
+	)
+	for _, hndl := range srv.stack.Load().handlers() {
+		ch, ok := hndl.(criticalHandler)
+		if !ok {
+			continue
+		}
+		go func() {
+			select {
+			case <-ch.failed():
+				mu.Lock()
+				if err == nil {
+					err = ch.failure()
+				}
+				mu.Unlock()
+				ln.Close()
+			case <-stop:
+			}
+		}()
+	}
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return err
+	}
+}
 
-		go srv.handleConnection(conn)
+// withCloseError adds any error from closing to err, leaving err as is
+// otherwise so that callers can still compare it directly.
+func withCloseError(err, closeErr error) error {
+	if closeErr == nil {
+		return err
 	}
+	return errors.Join(err, closeErr)
 }
 
-func (srv Server) closeDetectors() {
-	for _, det := range srv {
-		if closer, ok := det.Handler.(io.Closer); ok {
-			closer.Close() // TODO: do we care about err?
+func (srv *Server) closeDetectors() error {
+	var err error
+	for _, hndl := range srv.stack.Load().handlers() {
+		if closer, ok := hndl.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
 		}
 	}
+	return err
 }
 
-func (srv Server) handleConnection(conn net.Conn) {
+func (srv *Server) handleConnection(ln net.Listener, conn net.Conn, ticket *connTicket) {
 	// TODO: suspect could do better in slow case where we don't have any
 	// initial bytes yet... bufr doesn't seem to have a mechanism to wait for X
 	// bytes to be available, that then lets us give them all back
-	size := 512
-	for _, det := range srv {
-		if det.Needed > size {
-			size = det.Needed
+	stack := srv.acquireStack()
+	served := -1
+	defer func() { stack.release(served) }()
+	if acl := srv.acl.Load(); acl != nil && !acl.Allowed(conn.RemoteAddr()) {
+		if ticket != nil {
+			ticket.release()
+		}
+		srv.limiter.rejected(conn, nil, ErrDenied)
+		conn.Close()
+		return
+	}
+	bufr := bufio.NewReaderSize(conn, stack.size)
+	if ticket != nil {
+		if err := ticket.from(conn.RemoteAddr()); err != nil {
+			ticket.release()
+			srv.limiter.rejected(conn, nil, err)
+			conn.Close()
+			return
 		}
+		conn = &limitedConn{bufConn{conn, nil}, ticket}
 	}
-	bufr := bufio.NewReaderSize(conn, size)
 	i := 0
+	var passed []int // Detectors that matched, but passed the connection on
 	for k := 0; k < 10; k++ {
-		for ; i < len(srv); i++ {
-			det := srv[i]
+		for ; i < len(stack.detectors); i++ {
+			det := stack.detectors[i]
 			if b, _ := bufr.Peek(det.Needed); len(b) < det.Needed {
 				break
 			} else if det.Test(b) {
-				det.Handler.ServeConnection(conn, bufr)
+				if det.ACL != nil {
+					if rules := det.ACL.load(); !rules.allowed(conn.RemoteAddr()) {
+						if rules.Fallthrough {
+							passed = append(passed, i)
+							continue
+						}
+						srv.evaluateCandidates(conn, stack, bufr, i, passed)
+						srv.reject(conn, &det, ErrDenied)
+						return
+					}
+				}
+				if dec, ok := det.Handler.(Decliner); ok && !srv.accept(dec, conn, bufr) {
+					passed = append(passed, i)
+					continue
+				}
+				srv.evaluateCandidates(conn, stack, bufr, i, passed)
+				if ticket != nil {
+					if err := ticket.detected(stack, i, &det); err != nil {
+						srv.reject(conn, &det, err)
+						return
+					}
+				}
+				stack.serve(i)
+				served = i
+				serveWith(det.Handler, ln, conn, bufr)
 				return
 			}
 		}
 	}
+	srv.evaluateCandidates(conn, stack, bufr, -1, passed)
 	log.Printf("stacked: no detector wanted the connection")
 	conn.Close()
 }
+
+// reject has det respond to a connection that it can't take, and closes it.
+func (srv *Server) reject(conn net.Conn, det *Detector, err error) {
+	if det.Reject != nil {
+		det.Reject(conn, err)
+	}
+	srv.limiter.rejected(conn, det, err)
+	conn.Close()
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestServeConnAndStream(t *testing.T) {
+	srv := stacked.NewServer(
+		stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)),
+		stacked.DefaultHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "over "+r.RemoteAddr)
+		})),
+	)
+
+	client, server := net.Pipe()
+	go srv.ServeConn(server)
+	go io.WriteString(client, "echo via pipe\n")
+	if got, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	} else if got != "> echo via pipe\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	client.Close()
+
+	// hide everything but io.ReadWriteCloser, and serve HTTP through the
+	// ListenServerHandler shim
+	for i := 0; i < 2; i++ {
+		client, server = net.Pipe()
+		go srv.ServeStream(struct{ io.ReadWriteCloser }{server}, nil, nil)
+		req, _ := http.NewRequest("GET", "http://stream/", nil)
+		go req.Write(client)
+		resp, err := http.ReadResponse(bufio.NewReader(client), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "over stream" {
+			t.Fatalf("unexpected response %q", body)
+		}
+		client.Close()
+	}
+}
+
+func TestServeStartFailure(t *testing.T) {
+	good := newLifecycleHandler(nil)
+	errA, errB := errors.New("a failed"), errors.New("b failed")
+	srv := stacked.NewServer(
+		stacked.PrefixDetector("good", good),
+		stacked.PrefixDetector("a", newLifecycleHandler(errA)),
+		stacked.PrefixDetector("b", newLifecycleHandler(errB)),
+	)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.Serve(ln)
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Fatalf("expected both start errors, got %v", err)
+	}
+	select {
+	case <-good.stopped:
+	default:
+		t.Fatal("started handler wasn't stopped")
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("expected listener to be closed")
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	hndl := newLifecycleHandler(nil)
+	srv := stacked.NewServer(stacked.PrefixDetector("echo", hndl))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "echo before\n")
+	bufr := bufio.NewReader(conn)
+	if _, err := bufr.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if !hndl.started.Load() {
+		t.Fatal("handler wasn't started")
+	}
+
+	// the echo connection is still open, so Shutdown waits until the
+	// deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if err := <-served; err != stacked.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	select {
+	case <-hndl.stopped:
+	default:
+		t.Fatal("handler wasn't stopped")
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("expected listener to be closed")
+	}
+
+	conn.Close()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error once idle: %v", err)
+	}
+}
+
+func TestConnServerHandlerLifecycle(t *testing.T) {
+	hndl := newLifecycleHandler(nil)
+	inner := stacked.NewServer(stacked.PrefixDetector("echo", hndl))
+	srv := stacked.NewServer(stacked.FallthroughDetector(stacked.ConnServerHandler(inner)))
+	ln := serveTestServer(t, srv)
+
+	ec := dialEcho(t, ln)
+	if got := ec.echo("echo nested", time.Second); got != "> echo nested\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	if !hndl.started.Load() {
+		t.Fatal("nested handler wasn't started")
+	}
+	ec.Close()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-hndl.stopped:
+	default:
+		t.Fatal("nested handler wasn't stopped")
+	}
+}
+
+func TestServeAll(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixLn, err := net.Listen("unix", filepath.Join(t.TempDir(), "stacked.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as := &addrServer{}
+	srv := stacked.NewServer(
+		stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)),
+		stacked.FallthroughDetector(stacked.ListenServerHandler(as)),
+	)
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeAll(tcpLn, unixLn) }()
+
+	for _, ln := range []net.Listener{tcpLn, unixLn, tcpLn, unixLn} {
+		addr := ln.Addr()
+		conn, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "anything but echo\n")
+		if got, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		} else if got != addr.String()+"\n" {
+			t.Fatalf("expected listener address %v, got %q", addr, got)
+		}
+		conn.Close()
+	}
+	if n := as.serves.Load(); n != 2 {
+		t.Fatalf("expected one ListenServer Serve per listener, got %d", n)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != stacked.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	for _, ln := range []net.Listener{tcpLn, unixLn} {
+		if _, err := net.Dial(ln.Addr().Network(), ln.Addr().String()); err == nil {
+			t.Fatalf("expected %v to be closed", ln.Addr())
+		}
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stacked.sock")
+	srv := stacked.NewServer(stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe("127.0.0.1:0", "unix:"+path) }()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "echo over unix\n")
+	if got, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	} else if got != "> echo over unix\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+
+	srv.Close()
+	if err := <-served; err != stacked.ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultShadowBufferSize is the default for Shadow.BufferSize.
+const DefaultShadowBufferSize = 64 << 10
+
+var errShadowDropped = errors.New("stacked: shadow fell behind")
+
+// Shadow is a Handler that serves connections with Primary, while mirroring
+// their inbound bytes to a shadow Handler or upstream, whose responses are
+// discarded, e.g. to test a rewritten protocol server on production traffic.
+//
+// Primary gets a connection that copies whatever it reads to the mirror,
+// starting with any bytes already peeked during detection; writes, and
+// everything else, go to the client as usual.  A slow shadow never slows
+// Primary down: once more than BufferSize bytes are waiting for it, its
+// mirror is dropped.
+type Shadow struct {
+	Primary Handler
+
+	// Shadow, if non-nil, is served the mirrored connections, which ignore
+	// writes and deadlines.
+	Shadow Handler
+
+	// Upstream, if Shadow is nil, is dialed for each connection and sent
+	// the mirrored bytes, using Dial if non-nil.
+	Upstream string
+	Dial     func(network, addr string) (net.Conn, error)
+
+	// BufferSize bounds how many mirrored bytes wait for the shadow, per
+	// connection; it defaults to DefaultShadowBufferSize.
+	BufferSize int
+
+	conns, dropped        int64
+	mirrored, droppedData int64
+}
+
+// ShadowStats are a Shadow's counts so far.
+type ShadowStats struct {
+	// Conns is how many connections were mirrored, and Dropped how many of
+	// those mirrors were dropped, for the shadow falling behind or failing.
+	Conns, Dropped int64
+
+	// MirroredBytes is how many bytes were mirrored, and DroppedBytes how
+	// many more weren't, after mirrors were dropped.
+	MirroredBytes, DroppedBytes int64
+}
+
+// Stats returns the Shadow's counts so far.
+func (s *Shadow) Stats() ShadowStats {
+	return ShadowStats{
+		Conns:         atomic.LoadInt64(&s.conns),
+		Dropped:       atomic.LoadInt64(&s.dropped),
+		MirroredBytes: atomic.LoadInt64(&s.mirrored),
+		DroppedBytes:  atomic.LoadInt64(&s.droppedData),
+	}
+}
+
+// ServeConnection serves the connection with Primary, mirroring it to the
+// shadow.
+func (s *Shadow) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	s.serveListenerConnection(nil, conn, bufr)
+}
+
+func (s *Shadow) serveListenerConnection(ln net.Listener, conn net.Conn, bufr *bufio.Reader) {
+	size := s.BufferSize
+	if size <= 0 {
+		size = DefaultShadowBufferSize
+	}
+	m := &mirror{shadow: s, max: size}
+	m.cond.L = &m.mu
+	atomic.AddInt64(&s.conns, 1)
+
+	// replay what detection peeked, and tee the rest
+	peeked, _ := bufr.Peek(bufr.Buffered())
+	m.add(peeked)
+	tee := &teeConn{conn, m}
+	go s.serveShadow(m, conn)
+
+	// Primary gets the peeked bytes still buffered, as after detection
+	primary := bufio.NewReaderSize(&bufConn{tee, bufr}, bufr.Size())
+	primary.Peek(len(peeked))
+	serveWith(s.Primary, ln, tee, primary)
+}
+
+func (s *Shadow) serveShadow(m *mirror, conn net.Conn) {
+	sc := newStreamConn(m, conn.LocalAddr(), conn.RemoteAddr())
+	if s.Shadow != nil {
+		s.Shadow.ServeConnection(sc, bufio.NewReader(sc))
+		return
+	}
+
+	dial := s.Dial
+	if dial == nil {
+		dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, DefaultProxyDialTimeout)
+		}
+	}
+	upstream, err := dial("tcp", s.Upstream)
+	if err != nil {
+		log.Printf("stacked: shadow upstream %v: %v", s.Upstream, err)
+		m.drop(0)
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(io.Discard, upstream)
+	if _, err := io.Copy(upstream, sc); err != nil {
+		m.drop(0)
+	}
+}
+
+// Start starts Primary and Shadow.
+func (s *Shadow) Start(ctx context.Context) error {
+	return startHandlers(ctx, s.handlers())
+}
+
+// Stop stops Primary and Shadow.
+func (s *Shadow) Stop(ctx context.Context) error {
+	return stopHandlers(ctx, s.handlers())
+}
+
+// Close closes Primary and Shadow.
+func (s *Shadow) Close() error {
+	var err error
+	for _, hndl := range s.handlers() {
+		if closer, ok := hndl.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
+		}
+	}
+	return err
+}
+
+func (s *Shadow) closeListener(ln net.Listener) {
+	for _, hndl := range s.handlers() {
+		if lh, ok := hndl.(listenerHandler); ok {
+			lh.closeListener(ln)
+		}
+	}
+}
+
+func (s *Shadow) handlers() []Handler {
+	if s.Shadow == nil {
+		return []Handler{s.Primary}
+	}
+	return []Handler{s.Primary, s.Shadow}
+}
+
+// teeConn copies whatever is read from it to a mirror, which it closes once
+// closed itself.
+type teeConn struct {
+	net.Conn
+	m *mirror
+}
+
+// Read reads from the connection, copying to the mirror.
+func (tc *teeConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	if n > 0 {
+		tc.m.add(b[:n])
+	}
+	if err != nil {
+		tc.m.closeWrite()
+	}
+	return n, err
+}
+
+// Close closes the connection, and ends the mirror.
+func (tc *teeConn) Close() error {
+	tc.m.closeWrite()
+	return tc.Conn.Close()
+}
+
+// mirror is a bounded buffer of mirrored bytes, read by the shadow, which
+// discards whatever the shadow writes.
+type mirror struct {
+	shadow *Shadow
+	max    int
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	buf     []byte
+	eof     bool  // no more bytes are coming
+	err     error // the mirror was dropped or closed
+	dropped bool
+}
+
+// add adds mirrored bytes, dropping the mirror if they don't fit.
+func (m *mirror) add(b []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case len(b) == 0:
+	case m.dropped:
+		atomic.AddInt64(&m.shadow.droppedData, int64(len(b)))
+	case m.err != nil || m.eof:
+	case len(m.buf)+len(b) > m.max:
+		m.dropLocked(len(b))
+	default:
+		m.buf = append(m.buf, b...)
+		atomic.AddInt64(&m.shadow.mirrored, int64(len(b)))
+		m.cond.Broadcast()
+	}
+}
+
+// closeWrite marks the end of the mirrored bytes.
+func (m *mirror) closeWrite() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eof = true
+	m.cond.Broadcast()
+}
+
+// drop drops the mirror, counting n bytes that didn't fit.
+func (m *mirror) drop(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropLocked(n)
+}
+
+func (m *mirror) dropLocked(n int) {
+	if !m.dropped {
+		m.dropped = true
+		atomic.AddInt64(&m.shadow.dropped, 1)
+	}
+	atomic.AddInt64(&m.shadow.droppedData, int64(n))
+	if m.err == nil {
+		m.err = errShadowDropped
+	}
+	m.buf = nil
+	m.cond.Broadcast()
+}
+
+// Read reads mirrored bytes, for the shadow.
+func (m *mirror) Read(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.buf) == 0 && m.err == nil && !m.eof {
+		m.cond.Wait()
+	}
+	if m.err != nil {
+		return 0, m.err
+	}
+	if len(m.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, m.buf)
+	m.buf = m.buf[n:]
+	return n, nil
+}
+
+// Write discards the shadow's responses.
+func (m *mirror) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Close closes the mirror, for the shadow; anything else mirrored to it is
+// discarded.
+func (m *mirror) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = net.ErrClosed
+	}
+	m.buf = nil
+	m.cond.Broadcast()
+	return nil
+}
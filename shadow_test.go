@@ -0,0 +1,164 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+// shadowRecorder returns a shadow Handler that writes junk replies, sending
+// everything it reads once done.
+func shadowRecorder() (stacked.Handler, <-chan string) {
+	got := make(chan string, 1)
+	return stacked.HandlerFunc(func(conn net.Conn, bufr *bufio.Reader) {
+		io.WriteString(conn, "junk\n")
+		b, _ := io.ReadAll(bufr)
+		conn.Close()
+		got <- string(b)
+	}), got
+}
+
+func TestShadow(t *testing.T) {
+	shadowHndl, mirrored := shadowRecorder()
+	shadow := &stacked.Shadow{Primary: stacked.HandlerFunc(lineEcho), Shadow: shadowHndl}
+	ln := serveTest(t, stacked.PrefixDetector("echo", shadow))
+
+	ec := dialEcho(t, ln)
+	for _, line := range []string{"echo hello", "echo world"} {
+		if got := ec.echo(line, time.Second); got != "> "+line+"\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	ec.Close()
+
+	select {
+	case got := <-mirrored:
+		if got != "echo hello\necho world\n" {
+			t.Fatalf("unexpected mirrored bytes %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shadow never finished")
+	}
+	if stats := shadow.Stats(); stats != (stacked.ShadowStats{Conns: 1, MirroredBytes: 22}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestShadowSlow(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	shadow := &stacked.Shadow{
+		Primary: stacked.HandlerFunc(lineEcho),
+		Shadow: stacked.HandlerFunc(func(conn net.Conn, bufr *bufio.Reader) {
+			<-release
+			_, err := io.ReadAll(bufr)
+			done <- err
+		}),
+		BufferSize: 64,
+	}
+	ln := serveTest(t, stacked.PrefixDetector("echo", shadow))
+
+	ec := dialEcho(t, ln)
+	line := "echo " + strings.Repeat("x", 20)
+	for i := 0; i < 10; i++ {
+		if got := ec.echo(line, time.Second); got != "> "+line+"\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	}
+	close(release)
+	if err := <-done; err == nil {
+		t.Fatal("expected the shadow to see its mirror dropped")
+	}
+
+	stats := shadow.Stats()
+	if stats.Dropped != 1 || stats.MirroredBytes+stats.DroppedBytes != 260 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestShadowUpstream(t *testing.T) {
+	upstream := listenLocal(t)
+	mirrored := make(chan string, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "junk\n")
+		b, _ := io.ReadAll(conn)
+		mirrored <- string(b)
+	}()
+
+	shadow := &stacked.Shadow{
+		Primary:  stacked.HandlerFunc(lineEcho),
+		Upstream: upstream.Addr().String(),
+	}
+	ln := serveTest(t, stacked.PrefixDetector("echo", shadow))
+	ec := dialEcho(t, ln)
+	if got := ec.echo("echo upstream", time.Second); got != "> echo upstream\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	ec.Close()
+
+	select {
+	case got := <-mirrored:
+		if got != "echo upstream\n" {
+			t.Fatalf("unexpected mirrored bytes %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upstream never finished")
+	}
+}
+
+func TestShadowProxy(t *testing.T) {
+	echoLn, _ := echoServer(t)
+	defer echoLn.Close()
+	shadowHndl, mirrored := shadowRecorder()
+	shadow := &stacked.Shadow{
+		Primary: stacked.ProxyHandler(echoLn.Addr().String()),
+		Shadow:  shadowHndl,
+	}
+	ln := serveTest(t, stacked.PrefixDetector("echo", shadow))
+
+	// the detected prefix must reach both Primary and the shadow
+	ec := dialEcho(t, ln)
+	if got := ec.echo("echo hello", time.Second); got != "> echo hello\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	ec.Close()
+
+	select {
+	case got := <-mirrored:
+		if got != "echo hello\n" {
+			t.Fatalf("unexpected mirrored bytes %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shadow never finished")
+	}
+}
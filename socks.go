@@ -0,0 +1,373 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	socks5Version = 0x05
+	socks4Version = 0x04
+
+	socksCmdConnect = 0x01
+	socksCmdBind    = 0x02
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5Succeeded         = 0x00
+	socks5NotAllowed        = 0x02
+	socks5HostUnreachable   = 0x04
+	socks5ConnectionRefused = 0x05
+	socks5CmdNotSupported   = 0x07
+	socks5AtypNotSupported  = 0x08
+
+	socks4Granted           = 0x5a
+	socks4Rejected          = 0x5b
+	socks4IdentdUnconfirmed = 0x5d
+)
+
+// upper bound on SOCKS4 user ids and SOCKS4a host names
+const socks4MaxString = 255
+
+var errSOCKSMalformed = errors.New("malformed SOCKS request")
+
+// SOCKSHandler implements Handler for SOCKS4, SOCKS4a and SOCKS5 CONNECT
+// requests; other commands are refused, as are requests Allow doesn't grant.
+// Once a request is granted, data is piped between the client and the dialed
+// target.
+type SOCKSHandler struct {
+	// Authenticate, if non-nil, requires SOCKS5 clients to authenticate with
+	// a username and password (RFC 1929).  SOCKS4 clients only send a user
+	// id, which is checked with an empty password.
+	Authenticate func(user, password string) bool
+
+	// Allow is consulted for every request; returning false refuses it.
+	// The target is a "host:port" string, where host may be a domain name.
+	// If nil, every request is refused, so that a SOCKSHandler is never an
+	// open proxy by accident.
+	Allow func(conn net.Conn, user, target string) bool
+
+	// Dial connects to a target; net.Dial is used if nil.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// SOCKS5Detector returns a Detector that detects a SOCKS5 client greeting,
+// and hands it to hndl.
+func SOCKS5Detector(hndl *SOCKSHandler) Detector {
+	return Detector{
+		Needed: 2,
+		Test: func(b []byte) bool {
+			// version, and a non-zero number of auth methods
+			return b[0] == socks5Version && b[1] != 0
+		},
+		Handler: hndl,
+	}
+}
+
+// SOCKS4Detector returns a Detector that detects a SOCKS4 (or SOCKS4a)
+// request, and hands it to hndl.
+func SOCKS4Detector(hndl *SOCKSHandler) Detector {
+	return Detector{
+		Needed: 8, // version, command, port, and IPv4 address
+		Test: func(b []byte) bool {
+			return b[0] == socks4Version && (b[1] == socksCmdConnect || b[1] == socksCmdBind)
+		},
+		Handler: hndl,
+	}
+}
+
+// ServeConnection serves a SOCKS4 or SOCKS5 request, depending on the
+// version byte.
+func (sh *SOCKSHandler) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	b, err := bufr.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	switch b[0] {
+	case socks5Version:
+		sh.serveSOCKS5(conn, bufr)
+	case socks4Version:
+		sh.serveSOCKS4(conn, bufr)
+	default:
+		conn.Close()
+	}
+}
+
+func (sh *SOCKSHandler) serveSOCKS5(conn net.Conn, bufr *bufio.Reader) {
+	user, ok := sh.socks5Auth(conn, bufr)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	// ver:1 cmd:1 rsv:1 atyp:1
+	var hdr [4]byte
+	if _, err := io.ReadFull(bufr, hdr[:]); err != nil || hdr[0] != socks5Version {
+		conn.Close()
+		return
+	}
+	host, err := readSOCKS5Addr(bufr, hdr[3])
+	if err != nil {
+		if err == errSOCKSMalformed {
+			socks5Reply(conn, socks5AtypNotSupported, nil)
+		}
+		conn.Close()
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(bufr, port[:]); err != nil {
+		conn.Close()
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	if hdr[1] != socksCmdConnect {
+		socks5Reply(conn, socks5CmdNotSupported, nil)
+		conn.Close()
+		return
+	}
+	if !sh.allow(conn, user, target) {
+		socks5Reply(conn, socks5NotAllowed, nil)
+		conn.Close()
+		return
+	}
+	upstream, err := sh.dial(target)
+	if err != nil {
+		rep := byte(socks5HostUnreachable)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			rep = socks5ConnectionRefused
+		}
+		socks5Reply(conn, rep, nil)
+		conn.Close()
+		return
+	}
+	if err := socks5Reply(conn, socks5Succeeded, upstream.LocalAddr()); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	pipe(&bufConn{conn, bufr}, upstream)
+}
+
+// socks5Auth negotiates an authentication method, and then runs it,
+// returning the authenticated user name (if any) and whether to proceed.
+func (sh *SOCKSHandler) socks5Auth(conn net.Conn, bufr *bufio.Reader) (string, bool) {
+	// ver:1 (method:1)~1
+	var hdr [2]byte
+	if _, err := io.ReadFull(bufr, hdr[:]); err != nil {
+		return "", false
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(bufr, methods); err != nil {
+		return "", false
+	}
+
+	want := byte(socks5AuthNone)
+	if sh.Authenticate != nil {
+		want = socks5AuthPassword
+	}
+	found := false
+	for _, m := range methods {
+		if m == want {
+			found = true
+			break
+		}
+	}
+	if !found {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", false
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return "", false
+	}
+	if want == socks5AuthNone {
+		return "", true
+	}
+
+	// ver:1 (uname:1)~1 (passwd:1)~1
+	var ver [1]byte
+	if _, err := io.ReadFull(bufr, ver[:]); err != nil || ver[0] != 0x01 {
+		return "", false
+	}
+	user, err := readSOCKSString(bufr)
+	if err != nil {
+		return "", false
+	}
+	password, err := readSOCKSString(bufr)
+	if err != nil {
+		return "", false
+	}
+	if !sh.Authenticate(user, password) {
+		conn.Write([]byte{0x01, 0x01})
+		return "", false
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return "", false
+	}
+	return user, true
+}
+
+func (sh *SOCKSHandler) serveSOCKS4(conn net.Conn, bufr *bufio.Reader) {
+	// ver:1 cmd:1 port:2 ip:4 user~NUL [host~NUL]
+	var hdr [8]byte
+	if _, err := io.ReadFull(bufr, hdr[:]); err != nil {
+		conn.Close()
+		return
+	}
+	user, err := readNullTerminated(bufr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	host := net.IP(hdr[4:8]).String()
+	if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 && hdr[7] != 0 {
+		// SOCKS4a: the client couldn't resolve the host, and sends its name
+		if host, err = readNullTerminated(bufr); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(hdr[2:4]))))
+
+	if sh.Authenticate != nil && !sh.Authenticate(user, "") {
+		socks4Reply(conn, socks4IdentdUnconfirmed, nil)
+		conn.Close()
+		return
+	}
+	if hdr[1] != socksCmdConnect || !sh.allow(conn, user, target) {
+		socks4Reply(conn, socks4Rejected, nil)
+		conn.Close()
+		return
+	}
+	upstream, err := sh.dial(target)
+	if err != nil {
+		socks4Reply(conn, socks4Rejected, nil)
+		conn.Close()
+		return
+	}
+	if err := socks4Reply(conn, socks4Granted, upstream.LocalAddr()); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	pipe(&bufConn{conn, bufr}, upstream)
+}
+
+func (sh *SOCKSHandler) allow(conn net.Conn, user, target string) bool {
+	return sh.Allow != nil && sh.Allow(conn, user, target)
+}
+
+func (sh *SOCKSHandler) dial(target string) (net.Conn, error) {
+	if sh.Dial != nil {
+		return sh.Dial("tcp", target)
+	}
+	return net.Dial("tcp", target)
+}
+
+func readSOCKS5Addr(bufr *bufio.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AtypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		_, err := io.ReadFull(bufr, ip)
+		return ip.String(), err
+	case socks5AtypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		_, err := io.ReadFull(bufr, ip)
+		return ip.String(), err
+	case socks5AtypDomain:
+		return readSOCKSString(bufr)
+	default:
+		return "", errSOCKSMalformed
+	}
+}
+
+// readSOCKSString reads a single byte length prefixed string.
+func readSOCKSString(bufr *bufio.Reader) (string, error) {
+	n, err := bufr.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(bufr, b)
+	return string(b), err
+}
+
+func readNullTerminated(bufr *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := bufr.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) >= socks4MaxString {
+			return "", errSOCKSMalformed
+		}
+		b = append(b, c)
+	}
+}
+
+func socks5Reply(conn net.Conn, rep byte, addr net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+	b := []byte{socks5Version, rep, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	_, err := conn.Write(b)
+	return err
+}
+
+func socks4Reply(conn net.Conn, rep byte, addr net.Addr) error {
+	b := make([]byte, 8)
+	b[1] = rep
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(b[2:4], uint16(tcpAddr.Port))
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			copy(b[4:], ip4)
+		}
+	}
+	_, err := conn.Write(b)
+	return err
+}
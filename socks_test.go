@@ -0,0 +1,205 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+func socksProxy(t *testing.T, hndl *stacked.SOCKSHandler) net.Listener {
+	return serveTest(t, stacked.SOCKS5Detector(hndl), stacked.SOCKS4Detector(hndl))
+}
+
+func allowAll(net.Conn, string, string) bool { return true }
+
+func checkEcho(t *testing.T, conn net.Conn, bufr *bufio.Reader) {
+	io.WriteString(conn, "hello\n")
+	if got, err := bufr.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	} else if got != "> hello\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}
+
+func socks5Connect(t *testing.T, addr string, auth []byte, host string, port int) (net.Conn, *bufio.Reader, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufr := bufio.NewReader(conn)
+
+	method := byte(0x00)
+	if auth != nil {
+		method = 0x02
+	}
+	conn.Write([]byte{0x05, 0x01, method})
+	var sel [2]byte
+	if _, err := io.ReadFull(bufr, sel[:]); err != nil {
+		t.Fatal(err)
+	}
+	if sel[1] != method {
+		t.Fatalf("unexpected method selection %#x", sel[1])
+	}
+	if auth != nil {
+		conn.Write(auth)
+		var status [2]byte
+		if _, err := io.ReadFull(bufr, status[:]); err != nil {
+			t.Fatal(err)
+		}
+		if status[1] != 0x00 {
+			return conn, bufr, 0xff
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	conn.Write(req)
+	var rep [10]byte
+	if _, err := io.ReadFull(bufr, rep[:]); err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufr, rep[1]
+}
+
+func TestSOCKS5(t *testing.T) {
+	echoLn, port := echoServer(t)
+	defer echoLn.Close()
+
+	ln := socksProxy(t, &stacked.SOCKSHandler{
+		Allow: func(_ net.Conn, _, target string) bool {
+			return target == "localhost:"+strconv.Itoa(port)
+		},
+	})
+	defer ln.Close()
+
+	conn, bufr, rep := socks5Connect(t, ln.Addr().String(), nil, "localhost", port)
+	if rep != 0x00 {
+		t.Fatalf("unexpected reply %#x", rep)
+	}
+	checkEcho(t, conn, bufr)
+	conn.Close()
+
+	conn, _, rep = socks5Connect(t, ln.Addr().String(), nil, "127.0.0.1", port)
+	if rep != 0x02 {
+		t.Fatalf("expected not allowed reply, got %#x", rep)
+	}
+	conn.Close()
+}
+
+func TestSOCKSDeniedByDefault(t *testing.T) {
+	echoLn, port := echoServer(t)
+	defer echoLn.Close()
+
+	ln := socksProxy(t, &stacked.SOCKSHandler{})
+	defer ln.Close()
+
+	conn, _, rep := socks5Connect(t, ln.Addr().String(), nil, "localhost", port)
+	if rep != 0x02 {
+		t.Fatalf("expected not allowed reply, got %#x", rep)
+	}
+	conn.Close()
+}
+
+func TestSOCKS5Password(t *testing.T) {
+	echoLn, port := echoServer(t)
+	defer echoLn.Close()
+
+	var dialed []string
+	ln := socksProxy(t, &stacked.SOCKSHandler{
+		Authenticate: func(user, password string) bool {
+			return user == "bob" && password == "hunter2"
+		},
+		Allow: allowAll,
+		Dial: func(network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return net.Dial(network, addr)
+		},
+	})
+	defer ln.Close()
+
+	conn, _, rep := socks5Connect(t, ln.Addr().String(), []byte("\x01\x03bob\x05wrong"), "localhost", port)
+	if rep != 0xff {
+		t.Fatalf("expected authentication failure, got %#x", rep)
+	}
+	conn.Close()
+
+	conn, bufr, rep := socks5Connect(t, ln.Addr().String(), []byte("\x01\x03bob\x07hunter2"), "localhost", port)
+	if rep != 0x00 {
+		t.Fatalf("unexpected reply %#x", rep)
+	}
+	checkEcho(t, conn, bufr)
+	conn.Close()
+
+	if len(dialed) != 1 || dialed[0] != "localhost:"+strconv.Itoa(port) {
+		t.Fatalf("unexpected dials %v", dialed)
+	}
+}
+
+func TestSOCKS4(t *testing.T) {
+	echoLn, port := echoServer(t)
+	defer echoLn.Close()
+
+	ln := socksProxy(t, &stacked.SOCKSHandler{Allow: allowAll})
+	defer ln.Close()
+
+	for _, tt := range []struct {
+		name string
+		ip   net.IP
+		host string
+	}{
+		{"SOCKS4", net.IPv4(127, 0, 0, 1), ""},
+		{"SOCKS4a", net.IPv4(0, 0, 0, 1), "localhost"},
+	} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req bytes.Buffer
+		req.Write([]byte{0x04, 0x01})
+		binary.Write(&req, binary.BigEndian, uint16(port))
+		req.Write(tt.ip.To4())
+		req.WriteString("user\x00")
+		if tt.host != "" {
+			req.WriteString(tt.host + "\x00")
+		}
+		conn.Write(req.Bytes())
+
+		bufr := bufio.NewReader(conn)
+		var rep [8]byte
+		if _, err := io.ReadFull(bufr, rep[:]); err != nil {
+			t.Fatal(err)
+		}
+		if rep[1] != 0x5a {
+			t.Fatalf("%v: unexpected reply %#x", tt.name, rep[1])
+		}
+		checkEcho(t, conn, bufr)
+		conn.Close()
+	}
+}
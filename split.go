@@ -0,0 +1,177 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// SplitArm is one of the Handlers that a Split chooses between, receiving
+// Weight parts of the connections.
+type SplitArm struct {
+	Handler Handler
+	Weight  int
+}
+
+// Split is a Handler that splits connections between several Handlers by
+// weight, e.g. to roll out a new implementation of a protocol to a
+// percentage of clients.  Weights can be changed at any time with
+// SetWeights.
+type Split struct {
+	// Sticky chooses by a hash of the client IP, rather than at random, so
+	// that each client keeps getting the same Handler while the weights
+	// stay the same.  It must be set before serving.
+	Sticky bool
+
+	mu      sync.RWMutex
+	weights []int
+	total   int
+
+	arms  []Handler
+	conns []atomic.Int64
+}
+
+// NewSplit creates a Split between arms.
+func NewSplit(arms ...SplitArm) *Split {
+	s := &Split{
+		arms:    make([]Handler, len(arms)),
+		weights: make([]int, len(arms)),
+		conns:   make([]atomic.Int64, len(arms)),
+	}
+	for i, arm := range arms {
+		s.arms[i] = arm.Handler
+		s.weights[i] = max(arm.Weight, 0)
+		s.total += s.weights[i]
+	}
+	return s
+}
+
+// SetWeights sets new weights for the arms, in order.
+func (s *Split) SetWeights(weights ...int) error {
+	if len(weights) != len(s.arms) {
+		return fmt.Errorf("stacked: %d weights for %d arms", len(weights), len(s.arms))
+	}
+	total := 0
+	for _, w := range weights {
+		if w < 0 {
+			return fmt.Errorf("stacked: negative weight %d", w)
+		}
+		total += w
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.weights = append(s.weights[:0], weights...)
+	s.total = total
+	return nil
+}
+
+// Weights returns the current weights of the arms.
+func (s *Split) Weights() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]int(nil), s.weights...)
+}
+
+// Counts returns how many connections each arm has been given.
+func (s *Split) Counts() []int64 {
+	counts := make([]int64, len(s.conns))
+	for i := range s.conns {
+		counts[i] = s.conns[i].Load()
+	}
+	return counts
+}
+
+// choose picks the arm for a connection, or returns nil if all weights are
+// zero.
+func (s *Split) choose(conn net.Conn) Handler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.total == 0 {
+		return nil
+	}
+	var n int
+	if s.Sticky {
+		n = int(hashString(clientIP(conn.RemoteAddr())) % uint32(s.total))
+	} else {
+		n = rand.IntN(s.total)
+	}
+	for i, w := range s.weights {
+		if n < w {
+			s.conns[i].Add(1)
+			return s.arms[i]
+		}
+		n -= w
+	}
+	return nil // unreachable
+}
+
+// ServeConnection passes the connection to the chosen arm.
+func (s *Split) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	s.serveListenerConnection(nil, conn, bufr)
+}
+
+func (s *Split) serveListenerConnection(ln net.Listener, conn net.Conn, bufr *bufio.Reader) {
+	hndl := s.choose(conn)
+	if hndl == nil {
+		log.Printf("stacked: Split has no weight for %v", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	serveWith(hndl, ln, conn, bufr)
+}
+
+func (s *Split) closeListener(ln net.Listener) {
+	for _, hndl := range s.arms {
+		if lh, ok := hndl.(listenerHandler); ok {
+			lh.closeListener(ln)
+		}
+	}
+}
+
+// Start starts the arms.
+func (s *Split) Start(ctx context.Context) error {
+	return startHandlers(ctx, s.arms)
+}
+
+// Stop stops the arms.
+func (s *Split) Stop(ctx context.Context) error {
+	return stopHandlers(ctx, s.arms)
+}
+
+// Close closes the arms.
+func (s *Split) Close() error {
+	var err error
+	for _, hndl := range s.arms {
+		if closer, ok := hndl.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
+		}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestSplit(t *testing.T) {
+	split := stacked.NewSplit(
+		stacked.SplitArm{Handler: nameHandler("old"), Weight: 1},
+		stacked.SplitArm{Handler: nameHandler("new"), Weight: 0},
+	)
+	ln := serveTest(t, stacked.FallthroughDetector(split))
+	addr := ln.Addr().String()
+
+	tally := func(n int) map[string]int {
+		got := make(map[string]int)
+		for i := 0; i < n; i++ {
+			got[roundTrip(t, addr, "which?")]++
+		}
+		return got
+	}
+
+	if got := tally(10); got["old"] != 10 {
+		t.Fatalf("expected all old, got %v", got)
+	}
+	if err := split.SetWeights(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := tally(60); got["old"] == 0 || got["new"] == 0 {
+		t.Fatalf("expected both arms, got %v", got)
+	}
+	if counts := split.Counts(); counts[0]+counts[1] != 70 || counts[1] == 0 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	if err := split.SetWeights(1); err == nil {
+		t.Fatal("expected an error for too few weights")
+	}
+	if err := split.SetWeights(1, -1); err == nil {
+		t.Fatal("expected an error for a negative weight")
+	}
+	if weights := split.Weights(); weights[0] != 1 || weights[1] != 1 {
+		t.Fatalf("expected weights to be kept, got %v", weights)
+	}
+}
+
+func TestSplitSticky(t *testing.T) {
+	split := stacked.NewSplit(
+		stacked.SplitArm{Handler: nameHandler("old"), Weight: 1},
+		stacked.SplitArm{Handler: nameHandler("new"), Weight: 1},
+	)
+	split.Sticky = true
+	addr := serveTest(t, stacked.FallthroughDetector(split)).Addr().String()
+
+	// every connection comes from the same client IP
+	first := roundTrip(t, addr, "which?")
+	for i := 0; i < 20; i++ {
+		if got := roundTrip(t, addr, "which?"); got != first {
+			t.Fatalf("expected %q every time, got %q", first, got)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// detectorStack is a Server's list of Detectors, replaced as a whole by
+// SetDetectors.
+type detectorStack struct {
+	detectors []Detector
+	size      int              // of the bufio.Reader for detection
+	states    []*detectorState // for each Detector
+
+	mu        sync.Mutex
+	changed   sync.Cond // broadcast as connections finish
+	detecting int       // connections being handled, but not yet detected
+	serving   []int     // for each Detector, connections being handled
+	retired   bool
+}
+
+// detectorState is what's kept for a Detector across stacks, as long as its
+// Handler stays: its connection count for MaxConns, and its rate limit
+// buckets, keyed by the state itself.
+type detectorState struct {
+	conns int // guarded by the connLimiter
+}
+
+func newDetectorStack(detectors []Detector) *detectorStack {
+	size := 512
+	for _, det := range detectors {
+		if det.Needed > size {
+			size = det.Needed
+		}
+	}
+	stack := &detectorStack{
+		detectors: detectors,
+		size:      size,
+		states:    make([]*detectorState, len(detectors)),
+		serving:   make([]int, len(detectors)),
+	}
+	stack.changed.L = &stack.mu
+	for i := range stack.states {
+		stack.states[i] = &detectorState{}
+	}
+	return stack
+}
+
+// inherit carries over the state of old's Detectors whose Handlers are kept.
+func (stack *detectorStack) inherit(old *detectorStack) {
+	kept := make([]bool, len(old.detectors))
+	for i, det := range stack.detectors {
+		for j, odet := range old.detectors {
+			if !kept[j] && sameState(det.Handler, odet.Handler) {
+				kept[j] = true
+				stack.states[i] = old.states[j]
+				break
+			}
+		}
+	}
+}
+
+// conns returns the connection counts of each Detector.
+func (stack *detectorStack) conns() []int {
+	conns := make([]int, len(stack.states))
+	for i, state := range stack.states {
+		conns[i] = state.conns
+	}
+	return conns
+}
+
+// handlers returns the distinct Handlers of the stack.
+func (stack *detectorStack) handlers() []Handler {
+	var hndls []Handler
+	for _, det := range stack.detectors {
+		if !containsHandler(hndls, det.Handler) {
+			hndls = append(hndls, det.Handler)
+		}
+	}
+	return hndls
+}
+
+// acquire counts a connection as being detected, unless the stack has been
+// retired.
+func (stack *detectorStack) acquire() bool {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	if stack.retired {
+		return false
+	}
+	stack.detecting++
+	return true
+}
+
+// serve counts a connection being detected as handled by the i'th Detector.
+func (stack *detectorStack) serve(i int) {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	stack.detecting--
+	stack.serving[i]++
+}
+
+// release uncounts a connection, handled by the i'th Detector, or -1 if it
+// was never detected.
+func (stack *detectorStack) release(i int) {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	if i < 0 {
+		stack.detecting--
+	} else {
+		stack.serving[i]--
+	}
+	stack.changed.Broadcast()
+}
+
+// retire marks the stack as replaced, so that no more connections acquire
+// it.
+func (stack *detectorStack) retire() {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	stack.retired = true
+}
+
+// removedHandler is a Handler removed from a stack, with the indices of its
+// Detectors there.
+type removedHandler struct {
+	hndl Handler
+	dets []int
+}
+
+// removedHandlers returns the Handlers of old that aren't in stack.
+func (stack *detectorStack) removedHandlers(old *detectorStack) []removedHandler {
+	var removed []removedHandler
+	hndls := stack.handlers()
+outer:
+	for i, det := range old.detectors {
+		if containsHandler(hndls, det.Handler) {
+			continue
+		}
+		for j := range removed {
+			if sameHandler(removed[j].hndl, det.Handler) {
+				removed[j].dets = append(removed[j].dets, i)
+				continue outer
+			}
+		}
+		removed = append(removed, removedHandler{det.Handler, []int{i}})
+	}
+	return removed
+}
+
+// stopRemoved stops each of the retired stack's removed Handlers as soon as
+// no connections may be handled by it: once detection is done, and its own
+// Detectors' connections are.
+func (stack *detectorStack) stopRemoved(removed []removedHandler) {
+	stack.mu.Lock()
+	defer stack.mu.Unlock()
+	for len(removed) > 0 {
+		var idle []Handler
+		busy := removed[:0]
+		for _, r := range removed {
+			if stack.idle(r.dets) {
+				idle = append(idle, r.hndl)
+			} else {
+				busy = append(busy, r)
+			}
+		}
+		removed = busy
+		if len(idle) == 0 {
+			stack.changed.Wait()
+			continue
+		}
+		stack.mu.Unlock()
+		if err := stopHandlers(context.Background(), idle); err != nil {
+			log.Printf("stacked: stopping removed handlers: %v", err)
+		}
+		stack.mu.Lock()
+	}
+}
+
+// idle returns whether no connections may be handled by the given Detectors.
+func (stack *detectorStack) idle(dets []int) bool {
+	if stack.detecting > 0 {
+		return false
+	}
+	for _, i := range dets {
+		if stack.serving[i] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// acquireStack returns the current stack, counting a connection as being
+// detected.
+func (srv *Server) acquireStack() *detectorStack {
+	for {
+		if stack := srv.stack.Load(); stack.acquire() {
+			return stack
+		}
+	}
+}
+
+// Detectors returns the Server's current Detectors.
+func (srv *Server) Detectors() []Detector {
+	return append([]Detector(nil), srv.stack.Load().detectors...)
+}
+
+// SetDetectors atomically replaces the Server's Detectors.  New connections
+// are detected with the new ones, while connections already being handled
+// keep their handlers.
+//
+// Handlers that are new to the Server are started, if it has been, and if
+// any of them fail the old Detectors are kept.  Each Handler that was
+// removed is stopped (or closed) once the connections it's handling are
+// done, and none are still being detected with the old Detectors; for a
+// ListenServer shim that's once its ServeConnection has handed them off, and
+// stopping it then drains them gracefully.
+//
+// Detectors whose Handlers are kept keep their connection counts and rate
+// limits, for MaxConns, RateLimit and Stats.
+func (srv *Server) SetDetectors(detectors ...Detector) error {
+	srv.stackMu.Lock()
+	defer srv.stackMu.Unlock()
+	if srv.isClosed() {
+		return ErrServerClosed
+	}
+	old := srv.stack.Load()
+	stack := newDetectorStack(detectors)
+	stack.inherit(old)
+	added := handlersNotIn(stack.handlers(), old.handlers())
+	removed := stack.removedHandlers(old)
+
+	if srv.started {
+		if err := startHandlers(context.Background(), added); err != nil {
+			return err
+		}
+	}
+	srv.limiter.track(detectors)
+	srv.stack.Store(stack)
+	old.retire()
+	if len(removed) > 0 {
+		go old.stopRemoved(removed)
+	}
+	return nil
+}
+
+func handlersNotIn(hndls, others []Handler) []Handler {
+	var not []Handler
+	for _, hndl := range hndls {
+		if !containsHandler(others, hndl) {
+			not = append(not, hndl)
+		}
+	}
+	return not
+}
+
+func containsHandler(hndls []Handler, hndl Handler) bool {
+	for _, other := range hndls {
+		if sameHandler(other, hndl) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameState returns whether a Detector with Handler a may carry over the
+// state of one with Handler b: if they're the same, or the same function,
+// e.g. HandlerFunc(fn) both times.
+func sameState(a, b Handler) bool {
+	if sameHandler(a, b) {
+		return true
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	return va.IsValid() && vb.IsValid() && va.Type() == vb.Type() &&
+		va.Kind() == reflect.Func && va.Pointer() == vb.Pointer()
+}
+
+// sameHandler compares handlers, any of which may not be comparable, e.g. a
+// HandlerFunc; those are never the same.
+func sameHandler(a, b Handler) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() || va.Type() != vb.Type() || !va.Comparable() {
+		return false
+	}
+	return va.Equal(vb)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/uber-common/stacked"
+)
+
+func TestSetDetectors(t *testing.T) {
+	oldHndl := newLifecycleHandler(nil)
+	srv := stacked.NewServer(stacked.PrefixDetector("echo", oldHndl))
+	ln := serveTestServer(t, srv)
+
+	inFlight := dialEcho(t, ln)
+	if got := inFlight.echo("echo before", time.Second); got != "> echo before\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+
+	newHndl := newLifecycleHandler(nil)
+	if err := srv.SetDetectors(stacked.PrefixDetector("new", newHndl)); err != nil {
+		t.Fatal(err)
+	}
+	if !newHndl.started.Load() {
+		t.Fatal("expected new handler to be started")
+	}
+	if got := dialEcho(t, ln).echo("echo gone", time.Second); got != "" {
+		t.Fatalf("expected old detector to be gone, got %q", got)
+	}
+	if got := dialEcho(t, ln).echo("new here", time.Second); got != "> new here\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+
+	// the in-flight connection keeps its handler, which is only stopped
+	// once it's done
+	if got := inFlight.echo("echo still", time.Second); got != "> echo still\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	select {
+	case <-oldHndl.stopped:
+		t.Fatal("old handler stopped before draining")
+	case <-time.After(20 * time.Millisecond):
+	}
+	inFlight.Close()
+	select {
+	case <-oldHndl.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("old handler wasn't stopped once drained")
+	}
+
+	// failing to start keeps the current detectors
+	errStart := errors.New("can't start")
+	if err := srv.SetDetectors(stacked.PrefixDetector("bad", newLifecycleHandler(errStart))); !errors.Is(err, errStart) {
+		t.Fatalf("expected start error, got %v", err)
+	}
+	if dets := srv.Detectors(); len(dets) != 1 || dets[0].Handler != newHndl {
+		t.Fatalf("expected detectors to be kept, got %v", dets)
+	}
+}
+
+func TestSetDetectorsKeepsLimits(t *testing.T) {
+	admin := stacked.PrefixDetector("admin", stacked.HandlerFunc(lineEcho))
+	admin.MaxConns = 1
+	admin.Reject = func(conn net.Conn, err error) {
+		io.WriteString(conn, "busy\n")
+	}
+	srv := stacked.NewServer(admin)
+	ln := serveTestServer(t, srv)
+
+	if got := dialEcho(t, ln).echo("admin one", time.Second); got != "> admin one\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	// re-applying the same config keeps counting the open connection
+	if err := srv.SetDetectors(admin); err != nil {
+		t.Fatal(err)
+	}
+	if got := dialEcho(t, ln).echo("admin two", time.Second); got != "busy\n" {
+		t.Fatalf("expected rejection, got %q", got)
+	}
+	if stats := srv.Stats(); stats.Detectors[0] != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSetDetectorsStopsIdleHandlers(t *testing.T) {
+	oldHndl, newHndl := newLifecycleHandler(nil), newLifecycleHandler(nil)
+	echo := stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho))
+	srv := stacked.NewServer(echo, stacked.PrefixDetector("old", oldHndl))
+	ln := serveTestServer(t, srv)
+
+	longLived := dialEcho(t, ln)
+	if got := longLived.echo("echo hi", time.Second); got != "> echo hi\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+	if err := srv.SetDetectors(echo, stacked.PrefixDetector("new", newHndl)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the removed handler has no connections of its own, so it's stopped
+	// while the kept one is still serving
+	select {
+	case <-oldHndl.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("removed handler wasn't stopped")
+	}
+	if got := longLived.echo("echo still", time.Second); got != "> echo still\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// streamAddr is the net.Addr reported for streams served without addresses.
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+func (streamAddr) String() string  { return "stream" }
+
+// streamConn implements net.Conn around an io.ReadWriteCloser, e.g. an SSH
+// channel.  Deadlines are passed through if the stream supports them.
+type streamConn struct {
+	io.ReadWriteCloser
+	local, remote net.Addr
+}
+
+func newStreamConn(rwc io.ReadWriteCloser, local, remote net.Addr) *streamConn {
+	if local == nil {
+		local = streamAddr{}
+	}
+	if remote == nil {
+		remote = streamAddr{}
+	}
+	return &streamConn{rwc, local, remote}
+}
+
+// LocalAddr returns the local network address.
+func (sc *streamConn) LocalAddr() net.Addr {
+	return sc.local
+}
+
+// RemoteAddr returns the remote network address.
+func (sc *streamConn) RemoteAddr() net.Addr {
+	return sc.remote
+}
+
+// SetDeadline sets the read and write deadlines associated with the
+// stream.
+func (sc *streamConn) SetDeadline(t time.Time) error {
+	if d, ok := sc.ReadWriteCloser.(interface {
+		SetDeadline(time.Time) error
+	}); ok {
+		return d.SetDeadline(t)
+	}
+	return sc.unsupported("set")
+}
+
+// SetReadDeadline sets the deadline for future Read calls.
+func (sc *streamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := sc.ReadWriteCloser.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		return d.SetReadDeadline(t)
+	}
+	return sc.unsupported("set")
+}
+
+// SetWriteDeadline sets the deadline for future Write calls.
+func (sc *streamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := sc.ReadWriteCloser.(interface {
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return sc.unsupported("set")
+}
+
+// CloseWrite shuts down the writing side of the stream, if it supports that.
+func (sc *streamConn) CloseWrite() error {
+	if cw, ok := sc.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return sc.unsupported("closewrite")
+}
+
+func (sc *streamConn) unsupported(op string) error {
+	return &net.OpError{
+		Op:     op,
+		Source: sc.local,
+		Addr:   sc.remote,
+		Err:    errors.ErrUnsupported,
+	}
+}
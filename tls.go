@@ -189,23 +189,33 @@ type tlsShim struct {
 	config *tls.Config
 }
 
-func newTLSShim(config *tls.Config, srv ListenServer) *tlsShim {
-	return &tlsShim{connBufShim{Server: srv}, config}
+func newTLSShim(config *tls.Config, srv ListenServer, opts ListenServerOptions) *tlsShim {
+	return &tlsShim{connBufShim{Server: srv, ListenServerOptions: opts}, config}
 }
 
 func (ts *tlsShim) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
-	conn = &bufConn{conn, bufr}
-	conn = tls.Server(conn, ts.config)
-	ts.lnFor(conn).conns <- conn
+	ts.handoff(nil, tls.Server(&bufConn{conn, bufr}, ts.config))
+}
+
+func (ts *tlsShim) serveListenerConnection(ln net.Listener, conn net.Conn, bufr *bufio.Reader) {
+	ts.handoff(ln, tls.Server(&bufConn{conn, bufr}, ts.config))
 }
 
 // TLSServer returns a detector that detects a client TLS handshake before
 // wrapping each connection in tls.Server to pass to the ListenServer.
+//
+// The ListenServer gets plain *tls.Conns, as net/http expects; half-close and
+// raw socket access are available through their NetConn method.
 func TLSServer(config *tls.Config, srv ListenServer) Detector {
+	return TLSServerOptions(config, srv, ListenServerOptions{})
+}
+
+// TLSServerOptions is like TLSServer, but with explicit handoff options.
+func TLSServerOptions(config *tls.Config, srv ListenServer, opts ListenServerOptions) Detector {
 	// TODO: isTLSClientHello can really benefit from more bytes
 	return Detector{
 		Needed:  minBytes,
 		Test:    isTLSClientHello,
-		Handler: newTLSShim(config, srv),
+		Handler: newTLSShim(config, srv, opts),
 	}
 }
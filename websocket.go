@@ -0,0 +1,393 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum size of an HTTP request header that we'll buffer while deciding
+// whether a GET is a WebSocket upgrade
+const maxHeaderBytes = 8192
+
+// key suffix defined by https://tools.ietf.org/html/rfc6455#section-1.3
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+var (
+	errWSProtocol     = errors.New("websocket protocol error")
+	errWSFrameTooLong = errors.New("websocket frame too long")
+	errWSClosed       = errors.New("websocket closed")
+)
+
+// WebSocketDetector returns a detector that matches HTTP GET requests asking
+// to upgrade to the WebSocket protocol.  After completing the handshake, the
+// message stream is served as a new connection by srv, so that the same raw
+// Handlers can serve both TCP and browser clients.
+//
+// Since an upgrade can only be told apart from an ordinary GET after reading
+// its headers, any GET request that isn't an upgrade is passed, unconsumed, to
+// fallback; this is typically the same Handler as the one in a following HTTP
+// detector.  If fallback is nil, such requests get a 400 response.
+func WebSocketDetector(srv *Server, fallback Handler) Detector {
+	return Detector{
+		Needed:  len("GET "),
+		Test:    func(b []byte) bool { return string(b) == "GET " },
+		Handler: &wsShim{srv: srv, fallback: fallback},
+	}
+}
+
+// wsShim implements Handler by upgrading connections to WebSocket, and then
+// serving the message stream with a nested Server.
+type wsShim struct {
+	srv      *Server
+	fallback Handler
+}
+
+func (ws *wsShim) ServeConnection(conn net.Conn, bufr *bufio.Reader) {
+	bufr, hdr, err := peekHTTPHeader(conn, bufr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(hdr)))
+	if err != nil || !isWebSocketUpgrade(req) {
+		if ws.fallback != nil {
+			ws.fallback.ServeConnection(conn, bufr)
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+	bufr.Discard(len(hdr))
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nSec-WebSocket-Version: 13\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+wsAcceptKey(key)+"\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	ws.srv.ServeConn(newWSConn(conn, bufr))
+}
+
+// Start starts the nested Server's handlers.
+func (ws *wsShim) Start(ctx context.Context) error {
+	return ws.srv.start(ctx)
+}
+
+// Stop shuts down the nested Server.
+func (ws *wsShim) Stop(ctx context.Context) error {
+	return ws.srv.Shutdown(ctx)
+}
+
+// Close closes the nested Server's handlers.
+func (ws *wsShim) Close() error {
+	return ws.srv.closeDetectors()
+}
+
+// peekHTTPHeader peeks at, but doesn't consume, an HTTP request header
+// (through the terminating blank line).  If the header doesn't fit in bufr, a
+// larger buffered reader is returned in its place, still holding all unread
+// bytes.
+func peekHTTPHeader(conn net.Conn, bufr *bufio.Reader) (*bufio.Reader, []byte, error) {
+	for {
+		b, _ := bufr.Peek(bufr.Buffered())
+		if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+			return bufr, b[:i+4], nil
+		}
+		if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+			return bufr, b[:i+2], nil
+		}
+
+		// wait for at least one more byte
+		_, err := bufr.Peek(len(b) + 1)
+		if err == bufio.ErrBufferFull {
+			if bufr.Size() >= maxHeaderBytes {
+				return bufr, nil, err
+			}
+			bufr = bufio.NewReaderSize(&bufConn{conn, bufr}, maxHeaderBytes)
+		} else if err != nil {
+			return bufr, nil, err
+		}
+	}
+}
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	return req.Method == "GET" &&
+		headerHasToken(req.Header, "Connection", "upgrade") &&
+		headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsConn implements net.Conn around the server side of a WebSocket
+// connection.  Reads return the concatenated payloads of data frames, while
+// each Write is sent as a single binary frame.
+type wsConn struct {
+	conn net.Conn
+	bufr *bufio.Reader
+
+	rmu     sync.Mutex
+	remain  uint64 // unread payload bytes in the current data frame
+	mask    [4]byte
+	maskPos int
+	rerr    error
+
+	wmu        sync.Mutex
+	closeSent  bool
+	closeOnce  sync.Once
+	closeError error
+}
+
+func newWSConn(conn net.Conn, bufr *bufio.Reader) *wsConn {
+	return &wsConn{conn: conn, bufr: bufr}
+}
+
+// Read reads payload data, transparently answering control frames.
+func (wsc *wsConn) Read(b []byte) (int, error) {
+	wsc.rmu.Lock()
+	defer wsc.rmu.Unlock()
+
+	for wsc.remain == 0 {
+		if wsc.rerr != nil {
+			return 0, wsc.rerr
+		}
+		if err := wsc.nextFrame(); err != nil {
+			wsc.rerr = err
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > wsc.remain {
+		b = b[:wsc.remain]
+	}
+	n, err := wsc.bufr.Read(b)
+	for i := 0; i < n; i++ {
+		b[i] ^= wsc.mask[wsc.maskPos]
+		wsc.maskPos = (wsc.maskPos + 1) % 4
+	}
+	wsc.remain -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with some payload is
+// found, handling any control frames along the way.
+func (wsc *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(wsc.bufr, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0]&0x70 != 0 { // no extensions negotiated, so no RSV bits
+		return wsc.fail(errWSProtocol)
+	}
+	if hdr[1]&0x80 == 0 { // client frames must be masked
+		return wsc.fail(errWSProtocol)
+	}
+	op := hdr[0] & 0x0f
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(wsc.bufr, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(wsc.bufr, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return wsc.fail(errWSFrameTooLong)
+		}
+	}
+	if _, err := io.ReadFull(wsc.bufr, wsc.mask[:]); err != nil {
+		return err
+	}
+	wsc.maskPos = 0
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		wsc.remain = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+	default:
+		return wsc.fail(errWSProtocol)
+	}
+
+	// control frames must not be fragmented, and have at most 125 bytes
+	if hdr[0]&0x80 == 0 || length > 125 {
+		return wsc.fail(errWSProtocol)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(wsc.bufr, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= wsc.mask[i%4]
+	}
+
+	switch op {
+	case wsOpPing:
+		if err := wsc.writeFrame(wsOpPong, payload); err != nil {
+			return err
+		}
+	case wsOpClose:
+		// echo the status code back, if any, then we're done reading
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		wsc.writeFrame(wsOpClose, payload)
+		return io.EOF
+	}
+	return nil
+}
+
+// fail sends a protocol error close frame, returning err.
+func (wsc *wsConn) fail(err error) error {
+	wsc.writeFrame(wsOpClose, []byte{0x03, 0xea}) // 1002: protocol error
+	return err
+}
+
+func (wsc *wsConn) writeFrame(op byte, payload []byte) error {
+	wsc.wmu.Lock()
+	defer wsc.wmu.Unlock()
+
+	if wsc.closeSent {
+		return errWSClosed
+	}
+	if op == wsOpClose {
+		wsc.closeSent = true
+	}
+
+	var hdr [10]byte
+	hdr[0] = 0x80 | op
+	n := 2
+	switch length := len(payload); {
+	case length <= 125:
+		hdr[1] = byte(length)
+	case length <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(length))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(length))
+		n += 8
+	}
+	if _, err := wsc.conn.Write(hdr[:n]); err != nil {
+		return err
+	}
+	_, err := wsc.conn.Write(payload)
+	return err
+}
+
+// Write writes b as a single binary frame.
+func (wsc *wsConn) Write(b []byte) (int, error) {
+	if err := wsc.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a normal closure frame, and then closes the connection.
+func (wsc *wsConn) Close() error {
+	wsc.closeOnce.Do(func() {
+		wsc.writeFrame(wsOpClose, []byte{0x03, 0xe8}) // 1000: normal closure
+		wsc.closeError = wsc.conn.Close()
+	})
+	return wsc.closeError
+}
+
+// LocalAddr returns the local network address.
+func (wsc *wsConn) LocalAddr() net.Addr {
+	return wsc.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (wsc *wsConn) RemoteAddr() net.Addr {
+	return wsc.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines associated with the
+// connection.
+func (wsc *wsConn) SetDeadline(t time.Time) error {
+	return wsc.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls.
+func (wsc *wsConn) SetReadDeadline(t time.Time) error {
+	return wsc.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future Write calls.
+func (wsc *wsConn) SetWriteDeadline(t time.Time) error {
+	return wsc.conn.SetWriteDeadline(t)
+}
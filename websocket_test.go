@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Uber Technologies, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package stacked_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/uber-common/stacked"
+)
+
+func writeWSFrame(w io.Writer, op byte, payload []byte) error {
+	mask := [4]byte{1, 2, 3, 4}
+	hdr := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	hdr = append(hdr, mask[:]...)
+	masked := make([]byte, len(payload))
+	for i, c := range payload {
+		masked[i] = c ^ mask[i%4]
+	}
+	_, err := w.Write(append(hdr, masked...))
+	return err
+}
+
+func readWSFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return hdr[0] & 0x0f, payload, err
+}
+
+func TestWebSocketDetector(t *testing.T) {
+	httpHandler := stacked.DefaultHTTPHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "plain http")
+		}))
+	inner := stacked.NewServer(stacked.PrefixDetector("echo", stacked.HandlerFunc(lineEcho)))
+	ln := serveTest(t,
+		stacked.WebSocketDetector(inner, httpHandler.Handler),
+		httpHandler,
+	)
+	defer ln.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "plain http" {
+		t.Fatalf("unexpected fallback response %q", body)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	bufr := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(bufr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected handshake status %v", resp.Status)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key %q", accept)
+	}
+
+	// split the line over two frames, and throw in a ping
+	if err := writeWSFrame(conn, 0x2, []byte("echo he")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWSFrame(conn, 0x9, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeWSFrame(conn, 0x2, []byte("llo\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for len(got) < len("> echo hello\n") {
+		op, payload, err := readWSFrame(bufr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch op {
+		case 0xa:
+			if string(payload) != "hi" {
+				t.Fatalf("unexpected pong payload %q", payload)
+			}
+		case 0x2:
+			got = append(got, payload...)
+		default:
+			t.Fatalf("unexpected opcode %#x", op)
+		}
+	}
+	if string(got) != "> echo hello\n" {
+		t.Fatalf("unexpected echo %q", got)
+	}
+}